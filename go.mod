@@ -5,4 +5,5 @@ go 1.14
 require (
 	github.com/mattn/go-runewidth v0.0.8
 	golang.org/x/net v0.0.0-20200202094626-16171245cfb2
+	golang.org/x/text v0.3.0
 )
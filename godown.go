@@ -1,16 +1,27 @@
 package godown
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/mattn/go-runewidth"
 
 	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
 )
 
 // A regex to escape certain characters
@@ -28,11 +39,112 @@ import (
 // ` : Used for code blocks
 var escapeRegex = regexp.MustCompile(`(` + `\\|\*|_|\[|\]|\(|\)|<|>|#|\+|-|!|` + "`" + `)`)
 
+// A regex to escape text which would start an ordered list, such as "2. reasons"
+// ")" is escaped anyway, so only "." needs care here
+var listStartRegex = regexp.MustCompile(`^(\s*\d+)\.(\s|$)`)
+
+// A regex to detect conditional comments of Internet Explorer, such as
+// <!--[if IE]>...<![endif]--> and <!--[if !IE]><!-->...<!--<![endif]-->
+var conditionalCommentRegex = regexp.MustCompile(`^\s*(\[if\s[^\]]*\]|<!\[endif\])`)
+
+func escape(text string) string {
+	return escapeRegex.ReplaceAllStringFunc(text, func(str string) string {
+		return `\` + str
+	})
+}
+
+// A regex to escape characters in headings, which are single lines of inline
+// contents, so that only what would start inline syntax needs care
+var headingEscapeRegex = regexp.MustCompile(`(` + `\\|\[|\]|<|\*|_|` + "`" + `)`)
+
+// A regex to escape the closing sequence of a heading, such as "C #"
+var headingCloseRegex = regexp.MustCompile(`(^|\s)(#+)\s*$`)
+
+// Escapes the text of headings, leaving * and _ which can not be delimiters
+// of emphasis, such as in "2 * 3" or "snake_case", as is
+func escapeHeading(text string, beforeLink bool) string {
+	r := []rune(text)
+	isWord := func(i int) bool {
+		return i >= 0 && i < len(r) && (unicode.IsLetter(r[i]) || unicode.IsDigit(r[i]))
+	}
+	isSpace := func(i int) bool {
+		return i < 0 || i >= len(r) || unicode.IsSpace(r[i])
+	}
+
+	var buf strings.Builder
+	for i, c := range r {
+		s := string(c)
+		// "!" at the end of the text makes an image of the link after it
+		if c == '!' && i == len(r)-1 && beforeLink {
+			buf.WriteString(`\`)
+		}
+		if headingEscapeRegex.MatchString(s) {
+			switch {
+			case c == '*' && isSpace(i-1) && isSpace(i+1):
+			case c == '_' && isWord(i-1) && isWord(i+1):
+			default:
+				buf.WriteString(`\`)
+			}
+		}
+		buf.WriteString(s)
+	}
+	return headingCloseRegex.ReplaceAllString(buf.String(), `$1\$2`)
+}
+
+// Reports whether the node is rendered starting with the link, such as <a> or <b><a>
+func startsWithLink(node *html.Node) bool {
+	for node != nil && node.Type == html.ElementNode {
+		if strings.ToLower(node.Data) == "a" {
+			return true
+		}
+		node = node.FirstChild
+		for node != nil && node.Type == html.TextNode && strings.TrimSpace(node.Data) == "" {
+			node = node.NextSibling
+		}
+	}
+	return false
+}
+
+var spaceRegex = regexp.MustCompile(`[[:space:]][[:space:]]*`)
+
 func isChildOf(node *html.Node, name string) bool {
 	node = node.Parent
 	return node != nil && node.Type == html.ElementNode && strings.ToLower(node.Data) == name
 }
 
+func isDescendantOf(node *html.Node, name string) bool {
+	for node = node.Parent; node != nil; node = node.Parent {
+		if node.Type == html.ElementNode && strings.ToLower(node.Data) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the document has nothing but whitespace in it
+func isBlank(node *html.Node) bool {
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		switch c.Type {
+		case html.TextNode:
+			if strings.TrimSpace(c.Data) != "" {
+				return false
+			}
+		case html.ElementNode:
+			switch strings.ToLower(c.Data) {
+			case "html", "head", "body":
+				if !isBlank(c) {
+					return false
+				}
+			default:
+				return false
+			}
+		case html.CommentNode:
+			return false
+		}
+	}
+	return true
+}
+
 func hasClass(node *html.Node, clazz string) bool {
 	for _, attr := range node.Attr {
 		if attr.Key == "class" {
@@ -46,6 +158,15 @@ func hasClass(node *html.Node, clazz string) bool {
 	return false
 }
 
+func hasAttr(node *html.Node, key string) bool {
+	for _, attr := range node.Attr {
+		if attr.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
 func attr(node *html.Node, key string) string {
 	for _, attr := range node.Attr {
 		if attr.Key == key {
@@ -55,6 +176,57 @@ func attr(node *html.Node, key string) string {
 	return ""
 }
 
+// Reports the node discarded in the conversion to Option.OnDrop
+func drop(reason string, node *html.Node, option *Option) {
+	if option.OnDrop != nil {
+		option.OnDrop(reason, node)
+	}
+}
+
+// Returns the href of the base element in the head, or empty if none
+func baseHref(doc *html.Node) string {
+	head := findElement(doc, func(n *html.Node) bool {
+		return strings.ToLower(n.Data) == "head"
+	})
+	if head == nil {
+		return ""
+	}
+	base := findElement(head, func(n *html.Node) bool {
+		return strings.ToLower(n.Data) == "base" && attr(n, "href") != ""
+	})
+	if base == nil {
+		return ""
+	}
+	return attr(base, "href")
+}
+
+// Resolves a relative URL against Option.BaseURL
+// Fragment-only URLs point into the same document, so they are kept as is
+func resolveURL(ref string, option *Option) string {
+	if option.BaseURL == "" || ref == "" || strings.HasPrefix(ref, "#") {
+		return ref
+	}
+	base, err := url.Parse(option.BaseURL)
+	if err != nil {
+		return ref
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return base.ResolveReference(u).String()
+}
+
+// Resolves the URL, then rewrites it with Option.RewriteURL
+// kind is "link" or "image"
+func rewriteURL(kind, ref string, option *Option) string {
+	ref = resolveURL(ref, option)
+	if option.RewriteURL != nil && ref != "" {
+		ref = option.RewriteURL(kind, ref)
+	}
+	return ref
+}
+
 // Gets the language of a code block based on the class
 // See: https://spec.commonmark.org/0.29/#example-112
 func langFromClass(node *html.Node) string {
@@ -79,6 +251,29 @@ func langFromClass(node *html.Node) string {
 	return ""
 }
 
+// Ancestors farther than this from the code block are not looked at for the language
+const maxLangDepth = 3
+
+// Gets the language of a code block from data-lang, data-language or the
+// class of the code block itself or its ancestors, such as
+// <div class="highlight" data-lang="go"><pre>...</pre></div>
+func langFromAncestors(node *html.Node) string {
+	for depth := 0; node != nil && node.Type == html.ElementNode && depth <= maxLangDepth; depth++ {
+		for _, key := range []string{"data-lang", "data-language"} {
+			if lang := strings.TrimSpace(attr(node, key)); lang != "" {
+				return lang
+			}
+		}
+		for _, class := range strings.Fields(attr(node, "class")) {
+			if strings.HasPrefix(class, "language-") {
+				return strings.TrimPrefix(class, "language-")
+			}
+		}
+		node = node.Parent
+	}
+	return ""
+}
+
 func br(node *html.Node, w io.Writer, option *Option) {
 	node = node.PrevSibling
 	if node == nil {
@@ -106,6 +301,203 @@ func br(node *html.Node, w io.Writer, option *Option) {
 	}
 }
 
+func isBreak(node *html.Node) bool {
+	return node != nil && node.Type == html.ElementNode && strings.ToLower(node.Data) == "br"
+}
+
+// Counts the br elements right before the node, ignoring whitespace between them
+func breaksBefore(node *html.Node) int {
+	n := 0
+	for node = node.PrevSibling; node != nil; node = node.PrevSibling {
+		if node.Type == html.TextNode && strings.TrimSpace(node.Data) == "" {
+			continue
+		}
+		if !isBreak(node) {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// Writes the contents of the blockquote, prefixing every line with "> "
+func quote(s string, w io.Writer, option *Option) {
+	prefix := "> "
+	if option.PlainText {
+		prefix = "    "
+	}
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	fence, blank := "", false
+	for _, l := range lines {
+		// Every line of code blocks is kept as is, up to the closing fence
+		if fence != "" {
+			if strings.TrimSpace(l) == fence {
+				fence = ""
+			}
+			fmt.Fprint(w, prefix+l+"\n")
+			blank = false
+			continue
+		}
+		// Keep the indentation of nested blocks such as raw HTML,
+		// but drop a single space left by collapsed whitespace
+		l = strings.TrimRightFunc(l, unicode.IsSpace)
+		if strings.HasPrefix(l, " ") && !strings.HasPrefix(l, "  ") {
+			l = l[1:]
+		}
+		if isFence(l) {
+			fence = backticksRegex.FindString(l)
+		}
+		// Blocks such as thematic breaks are put apart by a single blank line
+		if l == "" && blank {
+			continue
+		}
+		blank = l == ""
+		fmt.Fprint(w, prefix+l+"\n")
+	}
+	fmt.Fprint(w, "\n")
+}
+
+// Gets the cite at the end of the blockquote, which may be put in the
+// block at the end such as footer
+func trailingCite(node *html.Node) *html.Node {
+	for c := node.LastChild; c != nil; c = c.PrevSibling {
+		if c.Type == html.TextNode && strings.TrimSpace(c.Data) == "" {
+			continue
+		}
+		if c.Type != html.ElementNode {
+			return nil
+		}
+		switch strings.ToLower(c.Data) {
+		case "cite":
+			return c
+		case "footer", "p", "div":
+			return trailingCite(c)
+		}
+		return nil
+	}
+	return nil
+}
+
+// Gets the blockquote of the same classes right after the node, which
+// Option.MergeAdjacentBlockquotes merges into the blockquote of the node
+func adjacentBlockquote(node *html.Node, option *Option) *html.Node {
+	if !option.MergeAdjacentBlockquotes {
+		return nil
+	}
+	for n := node.NextSibling; n != nil; n = n.NextSibling {
+		if n.Type == html.TextNode && strings.TrimSpace(n.Data) == "" {
+			continue
+		}
+		if n.Type == html.ElementNode && strings.ToLower(n.Data) == "blockquote" &&
+			strings.Join(strings.Fields(attr(n, "class")), " ") == strings.Join(strings.Fields(attr(node, "class")), " ") {
+			return n
+		}
+		break
+	}
+	return nil
+}
+
+// Gets the type of the GitHub alert, such as NOTE, for the classes of the
+// blockquote or the block wrapper such as div
+func alertType(node *html.Node, option *Option) string {
+	if name := strings.ToLower(node.Data); name != "blockquote" && !wrapperElements[name] {
+		return ""
+	}
+	for _, clazz := range strings.Fields(attr(node, "class")) {
+		if typ, ok := option.AlertClasses[clazz]; ok {
+			return strings.ToUpper(typ)
+		}
+	}
+	return ""
+}
+
+// Renders the definition list in the syntax of PHP Markdown Extra and Pandoc
+//
+//	Term
+//	: Definition
+//
+// Every line is written apart, so that blockquotes and list items can prefix them
+func dl(node *html.Node, w io.Writer, nest int, option *Option) {
+	clone := option.Clone()
+	clone.TrimSpace = true
+
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		var buf bytes.Buffer
+		walk(c, &buf, nest, clone)
+
+		var lines []string
+		for _, l := range strings.Split(buf.String(), "\n") {
+			if strings.TrimSpace(l) != "" {
+				lines = append(lines, strings.TrimRight(l, " "))
+			}
+		}
+		if len(lines) == 0 {
+			continue
+		}
+
+		switch strings.ToLower(c.Data) {
+		case "dt":
+			fmt.Fprint(w, strings.Join(lines, " ")+"\n")
+		case "dd":
+			// Plain text has the definitions indented under the terms
+			marker := ": "
+			if option.PlainText {
+				marker = "    "
+			}
+			fmt.Fprint(w, marker+strings.TrimLeft(lines[0], " ")+"\n")
+			for _, l := range lines[1:] {
+				fmt.Fprint(w, "    "+l+"\n")
+			}
+			if next := nextElement(c); next == nil || strings.ToLower(next.Data) == "dt" {
+				fmt.Fprint(w, "\n")
+			}
+		}
+	}
+}
+
+// Reports whether the node is a block of the document itself, and not
+// of the blocks such as list items, table cells or blockquotes
+func isTopLevel(node *html.Node) bool {
+	for _, name := range []string{"li", "td", "th", "blockquote", "dd"} {
+		if isDescendantOf(node, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// Gets the previous sibling which is not whitespace
+func prevSibling(node *html.Node) *html.Node {
+	for node = node.PrevSibling; node != nil; node = node.PrevSibling {
+		if node.Type != html.TextNode || strings.TrimSpace(node.Data) != "" {
+			return node
+		}
+	}
+	return nil
+}
+
+// Gets the li before the node in the same list
+func prevItem(node *html.Node) *html.Node {
+	for node = node.PrevSibling; node != nil; node = node.PrevSibling {
+		if node.Type == html.ElementNode && strings.ToLower(node.Data) == "li" {
+			return node
+		}
+	}
+	return nil
+}
+
+func nextElement(node *html.Node) *html.Node {
+	for node = node.NextSibling; node != nil; node = node.NextSibling {
+		if node.Type == html.ElementNode {
+			return node
+		}
+	}
+	return nil
+}
+
 func table(node *html.Node, w io.Writer, option *Option) {
 	var list []*html.Node // create a list not to mess up the loop
 
@@ -131,27 +523,75 @@ func table(node *html.Node, w io.Writer, option *Option) {
 		newTableNode.AppendChild(n)
 	}
 
+	// Pandoc has the syntax of captions, ": Caption" below the table,
+	// and the others have the caption as a paragraph above the table
+	caption := tableCaption(node, option)
+	if caption != "" && option.Dialect != Pandoc {
+		fmt.Fprint(w, caption+"\n\n")
+	}
 	tableRows(newTableNode, w, option)
 	fmt.Fprint(w, "\n")
+	if caption != "" && option.Dialect == Pandoc {
+		fmt.Fprint(w, ": "+caption+"\n\n")
+	}
+}
+
+// Gets the caption of the table on a single line
+func tableCaption(node *html.Node, option *Option) string {
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && strings.ToLower(c.Data) == "caption" {
+			var buf bytes.Buffer
+			walk(c, &buf, 0, option)
+			return strings.TrimSpace(lineBreakRegex.ReplaceAllString(buf.String(), " "))
+		}
+	}
+	return ""
 }
 
 func tableRows(node *html.Node, w io.Writer, option *Option) {
-	var rows [][]string
+	cellOption := option.Clone()
+	cellOption.inTableCell = true
+
+	var rows, aligns [][]string
 	for tr := node.FirstChild; tr != nil; tr = tr.NextSibling {
 		if tr.Type != html.ElementNode || strings.ToLower(tr.Data) != "tr" {
 			continue
 		}
-		var cols []string
+		var cols, colAligns []string
 		for td := tr.FirstChild; td != nil; td = td.NextSibling {
 			nodeType := strings.ToLower(td.Data)
 			if td.Type != html.ElementNode || (nodeType != "td" && nodeType != "th") {
 				continue
 			}
 			var buf bytes.Buffer
-			walk(td, &buf, 0, option)
-			cols = append(cols, buf.String())
+			walk(td, &buf, 0, cellOption)
+			// Rows must be on a single line, so the blocks in the cell are put apart by br
+			// Plain text has the breaks as spaces, and no pipes to escape
+			if option.PlainText {
+				cols = append(cols, strings.TrimSpace(spaceRegex.ReplaceAllString(buf.String(), " ")))
+			} else {
+				cell := lineBreakRegex.ReplaceAllString(strings.Trim(buf.String(), "\r\n"), "<br>")
+				cell = cellBreakRegex.ReplaceAllString(cell, "<br>")
+				if option.BoldRowHeaders && nodeType == "th" && strings.ToLower(attr(td, "scope")) == "row" {
+					cell = wrapNonWhitespace(cell, "**", "**")
+				}
+				// Pipes end the cell even inside code spans, so they are always escaped
+				// See: https://github.github.com/gfm/#example-200
+				cols = append(cols, strings.Replace(cell, "|", `\|`, -1))
+			}
+			colAligns = append(colAligns, cellAlign(td))
+			// The merged cells are padded with the empty cells to keep the columns in line
+			for span := colspan(td); span > 1; span-- {
+				cols = append(cols, "")
+				colAligns = append(colAligns, "")
+			}
 		}
 		rows = append(rows, cols)
+		aligns = append(aligns, colAligns)
+	}
+
+	if option.TrimEmptyTableColumns {
+		rows, aligns = trimEmptyColumns(rows, aligns)
 	}
 
 	maxcol := 0
@@ -160,6 +600,17 @@ func tableRows(node *html.Node, w io.Writer, option *Option) {
 			maxcol = len(cols)
 		}
 	}
+	// Nothing is left of the table, such as when every column is trimmed
+	if maxcol == 0 {
+		return
+	}
+	// Plain text has the cells separated by tabs, without the separator row
+	if option.PlainText {
+		for _, cols := range rows {
+			fmt.Fprint(w, strings.TrimRight(strings.Join(cols, "\t"), "\t")+"\n")
+		}
+		return
+	}
 	widths := make([]int, maxcol)
 	for _, cols := range rows {
 		for i := 0; i < maxcol; i++ {
@@ -171,6 +622,25 @@ func tableRows(node *html.Node, w io.Writer, option *Option) {
 			}
 		}
 	}
+	// The alignment of the column is of the header, or of the first data row
+	// if the header does not have one
+	heads := aligns
+	if len(heads) > 2 {
+		heads = heads[:2]
+	}
+	columnAligns := make([]string, maxcol)
+	for i := range columnAligns {
+		for _, colAligns := range heads {
+			if i < len(colAligns) && colAligns[i] != "" {
+				columnAligns[i] = colAligns[i]
+				break
+			}
+		}
+		// The separator needs room for the colons
+		if columnAligns[i] != "" && widths[i] < 3 {
+			widths[i] = 3
+		}
+	}
 	for i, cols := range rows {
 		for j := 0; j < maxcol; j++ {
 			fmt.Fprint(w, "|")
@@ -186,13 +656,131 @@ func tableRows(node *html.Node, w io.Writer, option *Option) {
 		if i == 0 {
 			for j := 0; j < maxcol; j++ {
 				fmt.Fprint(w, "|")
-				fmt.Fprint(w, strings.Repeat("-", widths[j]))
+				fmt.Fprint(w, alignSeparator(widths[j], columnAligns[j]))
 			}
 			fmt.Fprint(w, "|\n")
 		}
 	}
 }
 
+// Gets the number of the columns which the cell spans
+// The limit is of the HTML spec, 1000
+func colspan(node *html.Node) int {
+	n, err := strconv.Atoi(strings.TrimSpace(attr(node, "colspan")))
+	if err != nil || n < 1 {
+		return 1
+	}
+	if n > 1000 {
+		return 1000
+	}
+	return n
+}
+
+// Gets the alignment of the cell from the align attribute or text-align style,
+// which is "left", "center", "right" or empty
+func cellAlign(node *html.Node) string {
+	align := strings.ToLower(strings.TrimSpace(attr(node, "align")))
+	if align == "" {
+		align = inlineStyle(node)["text-align"]
+	}
+	switch align {
+	case "left", "center", "right":
+		return align
+	}
+	return ""
+}
+
+// Makes the separator of the header and the data rows with the colons of the alignment
+func alignSeparator(width int, align string) string {
+	switch align {
+	case "left":
+		return ":" + strings.Repeat("-", width-1)
+	case "center":
+		return ":" + strings.Repeat("-", width-2) + ":"
+	case "right":
+		return strings.Repeat("-", width-1) + ":"
+	}
+	return strings.Repeat("-", width)
+}
+
+// Removes the columns where every cell, including the header, is empty
+func trimEmptyColumns(rows, aligns [][]string) ([][]string, [][]string) {
+	maxcol := 0
+	for _, cols := range rows {
+		if len(cols) > maxcol {
+			maxcol = len(cols)
+		}
+	}
+	for i := maxcol - 1; i >= 0; i-- {
+		empty := true
+		for _, cols := range rows {
+			if i < len(cols) && strings.TrimSpace(cols[i]) != "" {
+				empty = false
+				break
+			}
+		}
+		if !empty {
+			continue
+		}
+		for j, cols := range rows {
+			if i < len(cols) {
+				rows[j] = append(cols[:i], cols[i+1:]...)
+				aligns[j] = append(aligns[j][:i], aligns[j][i+1:]...)
+			}
+		}
+	}
+	return rows, aligns
+}
+
+// Parses the inline style of the node into the properties, such as
+// "white-space: nowrap; color: red" into {"white-space": "nowrap", "color": "red"}
+func inlineStyle(node *html.Node) map[string]string {
+	props := map[string]string{}
+	for _, decl := range strings.Split(attr(node, "style"), ";") {
+		kv := strings.SplitN(decl, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		val := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(kv[1]), "!important"))
+		if key != "" {
+			props[key] = strings.ToLower(val)
+		}
+	}
+	return props
+}
+
+// Stands for the spaces of nowrap contents while wrapping lines
+const noWrapSpace = "\uE000"
+
+// A regex to detect words which would start a block at the beginning of a line,
+// such as "2." of an ordered list or "==" of a setext heading
+var blockStartWordRegex = regexp.MustCompile(`^(\d+[.)]|=+)$`)
+
+// Wraps the lines at spaces so that they fit in the width if possible
+func wrapLines(s string, width int) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		var wrapped []string
+		cur := ""
+		for j, word := range strings.Split(line, " ") {
+			if j > 0 && cur != "" && word != "" && !blockStartWordRegex.MatchString(word) &&
+				runewidth.StringWidth(strings.Replace(cur+" "+word, noWrapSpace, " ", -1)) > width {
+				wrapped = append(wrapped, cur)
+				cur = word
+				continue
+			}
+			if j > 0 {
+				cur += " "
+			}
+			cur += word
+		}
+		wrapped = append(wrapped, cur)
+		lines[i] = strings.Join(wrapped, "\n")
+	}
+	return strings.Replace(strings.Join(lines, "\n"), noWrapSpace, " ", -1)
+}
+
 var emptyElements = []string{
 	"area",
 	"base",
@@ -211,44 +799,899 @@ var emptyElements = []string{
 	"wbr",
 }
 
-func raw(node *html.Node, w io.Writer, option *Option) {
-	html.Render(w, node)
+// Gets the TeX annotation of MathML
+func texAnnotation(node *html.Node) string {
+	n := findElement(node, func(n *html.Node) bool {
+		return strings.ToLower(n.Data) == "annotation" && attr(n, "encoding") == "application/x-tex"
+	})
+	if n == nil {
+		return ""
+	}
+	var buf bytes.Buffer
+	pre(n, &buf, &Option{})
+	return strings.TrimSpace(buf.String())
 }
 
-func bq(node *html.Node, w io.Writer, option *Option) {
-	if node.Type == html.TextNode {
-		fmt.Fprint(w, strings.Replace(node.Data, "\u00a0", " ", -1))
+// Renders the image with the src, which may differ from the src attribute of node
+func image(node *html.Node, src string, w io.Writer, option *Option) {
+	// The name of the file is lost in data URIs and may be in rewritten URLs
+	original := src
+	if uri := dataURI(src, option); uri != "" {
+		src = uri
 	} else {
-		for c := node.FirstChild; c != nil; c = c.NextSibling {
-			bq(c, w, option)
+		src = rewriteURL("image", src, option)
+	}
+	alt := attr(node, "alt")
+	title := attr(node, "title")
+	// A thumbnail linking to the full image is often described by the link
+	if link := thumbnailLink(node); !hasAttr(node, "alt") && link != nil {
+		alt = attr(link, "title")
+		if alt == "" {
+			alt = title
+		}
+	}
+	// An empty alt means a decorative image, but a missing alt is just missing
+	if alt == "" && !hasAttr(node, "alt") && option.ImageAltFallback {
+		alt = altFromFilename(original)
+	}
+	if alt == "" && option.UseAriaLabels {
+		alt = attr(node, "aria-label")
+		if alt == "" {
+			alt = title
 		}
 	}
-}
 
-func pre(node *html.Node, w io.Writer, option *Option) {
-	if node.Type == html.TextNode {
-		fmt.Fprint(w, node.Data)
-	} else {
-		for c := node.FirstChild; c != nil; c = c.NextSibling {
-			pre(c, w, option)
+	if src == "" {
+		drop("image without src", node, option)
+		return
+	}
+
+	if option.PlainText {
+		fmt.Fprint(w, alt)
+		if option.ImageMaps {
+			imageMap(node, w, option)
 		}
+		return
 	}
-}
 
-// In the spec, https://spec.commonmark.org/0.29/#delimiter-run
+	width, height := imageSize(node)
+	text := alt
+	// Obsidian takes the dimensions after the alt, where the width is required
+	if option.ImageSizeMode == ImageSizeObsidian && width != "" {
+		text += "|" + width
+		if height != "" {
+			text += "x" + height
+		}
+	}
+	full := fmt.Sprintf("![%s](%s)", text, src)
+	if title != "" {
+		full = fmt.Sprintf("![%s](%s %q)", text, src, title)
+	}
+	if option.LinkStyle == ReferenceLink {
+		prefix := ""
+		if option.SeparateImageReferences {
+			prefix = "img"
+		}
+		full = fmt.Sprintf("![%s][%s]", text, option.refs.add(prefix, alt, src, title))
+	}
+	if option.ImageSizeMode == ImageSizePandoc && (width != "" || height != "") {
+		var attrs []string
+		if width != "" {
+			attrs = append(attrs, "width="+width)
+		}
+		if height != "" {
+			attrs = append(attrs, "height="+height)
+		}
+		full += "{" + strings.Join(attrs, " ") + "}"
+	}
+
+	fmt.Fprint(w, full)
+
+	if option.ImageMaps {
+		imageMap(node, w, option)
+	}
+}
+
+var imageSizeRegex = regexp.MustCompile(`^\s*(\d+)(?:px)?\s*$`)
+
+// Gets the width and height of the image in px, or empty strings for
+// missing ones and the others such as percentages
+func imageSize(node *html.Node) (string, string) {
+	var size [2]string
+	for i, name := range []string{"width", "height"} {
+		if m := imageSizeRegex.FindStringSubmatch(attr(node, name)); m != nil {
+			size[i] = m[1]
+		}
+	}
+	return size[0], size[1]
+}
+
+// Reads the local image with Option.FileResolver and returns it as a data URI.
+// It returns an empty string for remote images and images failed to read.
+func dataURI(src string, option *Option) string {
+	if !option.EmbedImages || option.FileResolver == nil || src == "" {
+		return ""
+	}
+	u, err := url.Parse(src)
+	if err != nil || u.Scheme != "" || u.Host != "" || strings.HasPrefix(src, "/") {
+		return ""
+	}
+	data, mime, err := option.FileResolver(u.Path)
+	if err != nil {
+		return ""
+	}
+	return "data:" + mime + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
+
+// Derives the alt from the filename of the image, such as "sunset beach" for
+// https://example.com/img/sunset_beach.jpg
+func altFromFilename(src string) string {
+	u, err := url.Parse(src)
+	if err != nil || u.Scheme == "data" {
+		return ""
+	}
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return ""
+	}
+	name = strings.TrimSuffix(name, path.Ext(name))
+	return strings.TrimSpace(strings.NewReplacer("_", " ", "-", " ").Replace(name))
+}
+
+// Gets the link around the image when the image is all of the link, such as
+// <a href="full.jpg"><img src="thumb.jpg"></a>
+func thumbnailLink(node *html.Node) *html.Node {
+	link := node.Parent
+	if link == nil || link.Type != html.ElementNode || strings.ToLower(link.Data) != "a" {
+		return nil
+	}
+	for c := link.FirstChild; c != nil; c = c.NextSibling {
+		if c != node && (c.Type != html.TextNode || strings.TrimSpace(c.Data) != "") {
+			return nil
+		}
+	}
+	return link
+}
+
+var mediaWidthRegex = regexp.MustCompile(`\(\s*(min|max)-width\s*:\s*(\d+)px\s*\)`)
+
+// Gets the src of the first source in the picture whose media query matches
+// the viewport width. It returns an empty string to use the fallback img.
+func pictureSource(node *html.Node, viewport int) string {
+	if viewport <= 0 {
+		return ""
+	}
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || strings.ToLower(c.Data) != "source" {
+			continue
+		}
+		matched := true
+		for _, m := range mediaWidthRegex.FindAllStringSubmatch(attr(c, "media"), -1) {
+			width, _ := strconv.Atoi(m[2])
+			if (m[1] == "min" && viewport < width) || (m[1] == "max" && viewport > width) {
+				matched = false
+			}
+		}
+		if !matched {
+			continue
+		}
+		if srcset := strings.Fields(strings.Split(attr(c, "srcset"), ",")[0]); len(srcset) > 0 {
+			return srcset[0]
+		}
+		if src := attr(c, "src"); src != "" {
+			return src
+		}
+	}
+	return ""
+}
+
+// Renders the object or embed as a link to its data or src
+func embedLink(node *html.Node, w io.Writer, option *Option) {
+	href := attr(node, "data")
+	if href == "" {
+		href = attr(node, "src")
+	}
+	if href = rewriteURL("link", href, option); href == "" {
+		drop("embed without URL", node, option)
+		return
+	}
+	text := attr(node, "title")
+	if text == "" {
+		text = href
+	}
+	if option.PlainText {
+		fmt.Fprint(w, text)
+		if text != href {
+			fmt.Fprint(w, " ("+href+")")
+		}
+		return
+	}
+	if !option.doNotEscape {
+		text = escape(text)
+	}
+	fmt.Fprintf(w, "[%s](%s)", text, href)
+}
+
+// Renders the poster of the video as the image linking to the video,
+// or just the image when the video has no source
+func videoPoster(node *html.Node, w io.Writer, option *Option) {
+	src := attr(node, "src")
+	if src == "" {
+		if source := findElement(node, func(n *html.Node) bool {
+			return strings.ToLower(n.Data) == "source" && attr(n, "src") != ""
+		}); source != nil {
+			src = attr(source, "src")
+		}
+	}
+	alt := attr(node, "title")
+	if alt == "" {
+		alt = "video"
+	}
+	if !option.doNotEscape {
+		alt = escape(alt)
+	}
+	img := fmt.Sprintf("![%s](%s)", alt, rewriteURL("image", attr(node, "poster"), option))
+	if src = rewriteURL("link", src, option); src == "" {
+		fmt.Fprint(w, img)
+		return
+	}
+	fmt.Fprintf(w, "[%s](%s)", img, src)
+}
+
+// Renders the options of the select as a list, with the options of each
+// optgroup indented under the bold label of the group
+func selectList(node *html.Node, w io.Writer, option *Option) {
+	marker := option.bulletChar() + strings.Repeat(" ", option.listMarkerSpacing())
+	if option.PlainText {
+		marker = ""
+	}
+	text := func(n *html.Node) string {
+		t := attr(n, "label")
+		if t == "" {
+			var buf bytes.Buffer
+			pre(n, &buf, &Option{})
+			t = buf.String()
+		}
+		// The options of datalist often have only the value
+		if strings.TrimSpace(t) == "" {
+			t = attr(n, "value")
+		}
+		t = strings.TrimSpace(spaceRegex.ReplaceAllString(t, " "))
+		if !option.doNotEscape {
+			t = escape(t)
+		}
+		return t
+	}
+
+	var lines []string
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		switch strings.ToLower(c.Data) {
+		case "option":
+			if t := text(c); t != "" {
+				lines = append(lines, marker+t)
+			}
+		case "optgroup":
+			label := text(c)
+			if !option.PlainText && label != "" {
+				label = "**" + label + "**"
+			}
+			lines = append(lines, marker+label)
+			for o := c.FirstChild; o != nil; o = o.NextSibling {
+				if o.Type == html.ElementNode && strings.ToLower(o.Data) == "option" {
+					if t := text(o); t != "" {
+						lines = append(lines, option.listIndent(marker)+marker+t)
+					}
+				}
+			}
+		}
+	}
+	if len(lines) > 0 {
+		fmt.Fprint(w, strings.Join(lines, "\n")+"\n\n")
+	}
+}
+
+// Gets the text of the label of the input which refers to the datalist
+func datalistLabel(node *html.Node, option *Option) string {
+	id := attr(node, "id")
+	if id == "" {
+		return ""
+	}
+	doc := node
+	for doc.Parent != nil {
+		doc = doc.Parent
+	}
+	input := findElement(doc, func(n *html.Node) bool {
+		return strings.ToLower(n.Data) == "input" && attr(n, "list") == id
+	})
+	if input == nil {
+		return ""
+	}
+	label := findElement(doc, func(n *html.Node) bool {
+		if strings.ToLower(n.Data) != "label" {
+			return false
+		}
+		if inputID := attr(input, "id"); inputID != "" && attr(n, "for") == inputID {
+			return true
+		}
+		// The label may wrap the input instead
+		for p := input.Parent; p != nil; p = p.Parent {
+			if p == n {
+				return true
+			}
+		}
+		return false
+	})
+	if label == nil {
+		return ""
+	}
+	var buf bytes.Buffer
+	pre(label, &buf, &Option{})
+	text := strings.TrimSpace(spaceRegex.ReplaceAllString(buf.String(), " "))
+	if !option.doNotEscape {
+		text = escape(text)
+	}
+	return text
+}
+
+// Keeps details and summary as raw HTML, converting the contents inside.
+// Blank lines end the HTML blocks so that the contents are converted.
+func details(node *html.Node, w io.Writer, nest int, option *Option) {
+	open := "<details>"
+	if hasAttr(node, "open") {
+		open = "<details open>"
+	}
+	fmt.Fprint(w, open+"\n")
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && strings.ToLower(c.Data) == "summary" {
+			// Markdown is not converted inside the HTML block, so the summary is kept as is
+			raw(c, w, option)
+			fmt.Fprint(w, "\n")
+			break
+		}
+	}
+	fmt.Fprint(w, "\n")
+	walk(node, w, nest, option)
+	fmt.Fprint(w, "\n\n</details>\n\n")
+}
+
+// Renders the contents of the figure followed by the caption. The images of
+// a gallery, a figure of only images, are put on their own lines.
+func figure(node *html.Node, w io.Writer, nest int, option *Option) {
+	var caption *html.Node
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && strings.ToLower(c.Data) == "figcaption" {
+			caption = c
+			break
+		}
+	}
+	// The caption is taken out of the tree to be rendered after the contents
+	if caption != nil {
+		node.RemoveChild(caption)
+	}
+
+	var buf bytes.Buffer
+	if isGallery(node) {
+		var images []*html.Node // create a list not to mess up the loop
+		for c := node.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode {
+				images = append(images, c)
+			}
+		}
+		for _, img := range images {
+			n := new(html.Node)
+			node.RemoveChild(img)
+			n.AppendChild(img)
+			walk(n, &buf, nest, option)
+			buf.WriteString("\n")
+		}
+	} else {
+		walk(node, &buf, nest, option)
+	}
+	if body := strings.TrimSpace(buf.String()); body != "" {
+		fmt.Fprint(w, body+"\n")
+	}
+
+	if caption != nil {
+		var buf bytes.Buffer
+		walk(caption, &buf, nest, option)
+		if text := strings.TrimSpace(buf.String()); text != "" {
+			fmt.Fprint(w, "\n"+text+"\n")
+		}
+	}
+	fmt.Fprint(w, "\n")
+}
+
+// Reports whether the node has only images, which may be in picture or links
+func isGallery(node *html.Node) bool {
+	found := false
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		switch {
+		case c.Type == html.TextNode && strings.TrimSpace(c.Data) == "":
+		case c.Type != html.ElementNode:
+			return false
+		case strings.ToLower(c.Data) == "img" || strings.ToLower(c.Data) == "picture":
+			found = true
+		case strings.ToLower(c.Data) == "a" && isGallery(c):
+			found = true
+		default:
+			return false
+		}
+	}
+	return found
+}
+
+// Renders the areas of the map used by the image as a list of links
+func imageMap(node *html.Node, w io.Writer, option *Option) {
+	name := strings.TrimPrefix(attr(node, "usemap"), "#")
+	if name == "" {
+		return
+	}
+
+	root := node
+	for root.Parent != nil {
+		root = root.Parent
+	}
+	m := findElement(root, func(n *html.Node) bool {
+		return strings.ToLower(n.Data) == "map" && attr(n, "name") == name
+	})
+	if m == nil {
+		return
+	}
+
+	// Plain text has the links as "text (url)" without the markers, like selectList
+	marker := option.bulletChar() + strings.Repeat(" ", option.listMarkerSpacing())
+	var links []string
+	findElement(m, func(n *html.Node) bool {
+		if strings.ToLower(n.Data) == "area" && attr(n, "href") != "" {
+			href := rewriteURL("link", attr(n, "href"), option)
+			if href == "" {
+				return false
+			}
+			text := attr(n, "alt")
+			if option.PlainText {
+				if text == "" || text == href {
+					links = append(links, href)
+				} else {
+					links = append(links, text+" ("+href+")")
+				}
+				return false
+			}
+			if text == "" {
+				text = href
+			}
+			if !option.doNotEscape {
+				text = escape(text)
+			}
+			links = append(links, fmt.Sprintf("%s[%s](%s)", marker, text, href))
+		}
+		return false
+	})
+	if len(links) > 0 {
+		fmt.Fprint(w, "\n\n"+strings.Join(links, "\n")+"\n\n")
+	}
+}
+
+// Gets the first element matching the selector, which is a comma-separated
+// list of tag names, #id and .class tried in order, such as "main, article"
+func selectRoot(doc *html.Node, selector string) *html.Node {
+	for _, sel := range strings.Split(selector, ",") {
+		sel = strings.TrimSpace(sel)
+		if sel == "" {
+			continue
+		}
+		n := findElement(doc, func(n *html.Node) bool {
+			switch {
+			case strings.HasPrefix(sel, "#"):
+				return attr(n, "id") == sel[1:]
+			case strings.HasPrefix(sel, "."):
+				return hasClass(n, sel[1:])
+			}
+			return strings.ToLower(n.Data) == strings.ToLower(sel)
+		})
+		if n != nil {
+			return n
+		}
+	}
+	return nil
+}
+
+// Returns the first element under node for which match returns true
+func findElement(node *html.Node, match func(*html.Node) bool) *html.Node {
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && match(c) {
+			return c
+		}
+		if found := findElement(c, match); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// Elements which only wrap their contents and are stripped in the conversion,
+// mapped to whether they are blocks
+var wrapperElements = map[string]bool{
+	"div": true, "section": true, "article": true, "aside": true, "header": true,
+	"footer": true, "nav": true, "main": true, "center": true,
+	"span": false, "font": false,
+}
+
+var blockElements = map[string]bool{
+	"p": true, "ul": true, "ol": true, "dl": true, "div": true, "blockquote": true, "pre": true,
+	"table": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+}
+
+// Reports whether the node has block contents
+func hasBlock(node *html.Node) bool {
+	return findElement(node, func(n *html.Node) bool { return blockElements[strings.ToLower(n.Data)] }) != nil
+}
+
+// Elements which are not kept by Option.KeepStyledElements, since they are parts
+// of the elements around them, have contents which must stay literal, or are
+// rendered as a whole by their own handlers
+var unstyledElements = map[string]bool{
+	"html": true, "head": true, "body": true, "li": true, "dt": true, "dd": true,
+	"thead": true, "tbody": true, "tfoot": true, "tr": true, "th": true, "td": true, "caption": true,
+	"ul": true, "ol": true, "dl": true, "table": true, "pre": true, "code": true, "kbd": true,
+	"samp": true, "tt": true, "var": true, "script": true, "style": true, "math": true, "svg": true,
+	"template": true, "figure": true, "figcaption": true, "details": true, "summary": true,
+	"select": true, "datalist": true, "optgroup": true, "option": true, "picture": true,
+	"a": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+}
+
+func isStyledElement(node *html.Node) bool {
+	name := strings.ToLower(node.Data)
+	if unstyledElements[name] {
+		return false
+	}
+	for _, e := range emptyElements {
+		if name == e {
+			return false
+		}
+	}
+	return hasAttr(node, "class") || hasAttr(node, "id")
+}
+
+// Keeps the tags of the element as raw HTML, converting the contents inside
+func styledElement(node *html.Node, w io.Writer, nest int, option *Option) {
+	name := strings.ToLower(node.Data)
+	keepTags(node, w, nest, option, wrapperElements[name] || blockElements[name])
+}
+
+// Keeps the tags of the node as raw HTML, converting the contents inside
+func keepTags(node *html.Node, w io.Writer, nest int, option *Option, block bool) {
+	name := strings.ToLower(node.Data)
+	var tag bytes.Buffer
+	tag.WriteString("<" + name)
+	for _, a := range node.Attr {
+		// The URLs are resolved and rewritten like those of links and images
+		switch strings.ToLower(a.Key) {
+		case "href", "cite":
+			if a.Val = rewriteURL("link", a.Val, option); a.Val == "" {
+				continue
+			}
+		case "src":
+			if a.Val = rewriteURL("image", a.Val, option); a.Val == "" {
+				continue
+			}
+		}
+		fmt.Fprintf(&tag, ` %s="%s"`, a.Key, html.EscapeString(a.Val))
+	}
+	tag.WriteString(">")
+
+	if block {
+		// A blank line ends the HTML block so that the contents are converted
+		br(node, w, option)
+		fmt.Fprint(w, tag.String()+"\n\n")
+		walk(node, w, nest, option)
+		fmt.Fprint(w, "\n\n</"+name+">\n\n")
+	} else {
+		fmt.Fprint(w, tag.String())
+		walk(node, w, nest, option)
+		fmt.Fprint(w, "</"+name+">")
+	}
+}
+
+var placeholderRegex = regexp.MustCompile(`\{\{\s*\.([\w-]+)\s*\}\}`)
+
+// Fills the placeholders such as {{.src}} of the template with the attributes
+// of the node. Attributes of descendants fill in those missing on the node,
+// so that the src of the img of a figure is available, and {{.text}} is the
+// text of the contents.
+//
+// Placeholders are replaced by hand, since the {{< and >}} of Hugo shortcodes
+// would be taken as actions by text/template.
+func shortcode(node *html.Node, tmpl string) string {
+	data := map[string]string{}
+	for _, a := range node.Attr {
+		data[a.Key] = a.Val
+	}
+	findElement(node, func(n *html.Node) bool {
+		for _, a := range n.Attr {
+			if _, ok := data[a.Key]; !ok {
+				data[a.Key] = a.Val
+			}
+		}
+		return false
+	})
+	if _, ok := data["text"]; !ok {
+		var buf bytes.Buffer
+		pre(node, &buf, &Option{})
+		data["text"] = strings.TrimSpace(spaceRegex.ReplaceAllString(buf.String(), " "))
+	}
+
+	return placeholderRegex.ReplaceAllStringFunc(tmpl, func(s string) string {
+		return data[placeholderRegex.FindStringSubmatch(s)[1]]
+	})
+}
+
+func raw(node *html.Node, w io.Writer, option *Option) {
+	if s, ok := option.rawScripts[node]; ok {
+		fmt.Fprint(w, s)
+		return
+	}
+	html.Render(w, node)
+}
+
+// Maps the script and style elements to their source, since html.Render
+// rewrites the tags, such as async to async="". The tokenizer does not know
+// the contexts the parser does, such as svg, so the source is used only when
+// its contents are the text of the element.
+func rawScripts(doc *html.Node, src []byte) map[*html.Node]string {
+	type source struct {
+		text, raw string
+	}
+	var sources []source
+	z := html.NewTokenizer(bytes.NewReader(src))
+	var cur, text *bytes.Buffer
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		// TagName lowers the raw bytes in place, so copy them first
+		raw := append([]byte(nil), z.Raw()...)
+		name, _ := z.TagName()
+		tag := string(name)
+		switch {
+		case tt == html.StartTagToken && (tag == "script" || tag == "style"):
+			cur = bytes.NewBuffer(raw)
+			text = &bytes.Buffer{}
+		case cur != nil && tt == html.EndTagToken && (tag == "script" || tag == "style"):
+			cur.Write(raw)
+			sources = append(sources, source{text.String(), cur.String()})
+			cur = nil
+		case cur != nil:
+			cur.Write(raw)
+			// Text normalizes the newlines as the parser does
+			text.Write(z.Text())
+		}
+	}
+
+	m := map[*html.Node]string{}
+	i := 0
+	findElement(doc, func(n *html.Node) bool {
+		if tag := strings.ToLower(n.Data); tag != "script" && tag != "style" {
+			return false
+		}
+		var buf bytes.Buffer
+		pre(n, &buf, &Option{})
+		// Elements without the matching source fall back to html.Render
+		for j := i; j < len(sources); j++ {
+			if sources[j].text == buf.String() {
+				m[n] = sources[j].raw
+				i = j + 1
+				break
+			}
+		}
+		return false
+	})
+	return m
+}
+
+func bq(node *html.Node, w io.Writer, option *Option) {
+	if node.Type == html.TextNode {
+		fmt.Fprint(w, strings.Replace(node.Data, "\u00a0", " ", -1))
+	} else {
+		for c := node.FirstChild; c != nil; c = c.NextSibling {
+			bq(c, w, option)
+		}
+	}
+}
+
+func pre(node *html.Node, w io.Writer, option *Option) {
+	if node.Type == html.TextNode {
+		fmt.Fprint(w, node.Data)
+	} else {
+		if option.StripLineNumbers && isLineNumber(node) {
+			return
+		}
+		if isBreak(node) {
+			fmt.Fprint(w, "\n")
+			return
+		}
+		for c := node.FirstChild; c != nil; c = c.NextSibling {
+			pre(c, w, option)
+		}
+	}
+}
+
+var lineNumberClasses = []string{"line-number", "line-numbers", "linenumber", "lineno", "linenos", "ln"}
+
+func isLineNumber(node *html.Node) bool {
+	for _, clazz := range lineNumberClasses {
+		if hasClass(node, clazz) {
+			return true
+		}
+	}
+	return false
+}
+
+var lineNumbersRegex = regexp.MustCompile(`^[[:space:]\d]+$`)
+
+// Gets the cell containing the code of a table made by syntax highlighters,
+// which puts the line numbers and the code in two separate columns
+func lineNumberedCode(node *html.Node) *html.Node {
+	var pres []*html.Node
+	findElement(node, func(n *html.Node) bool {
+		if strings.ToLower(n.Data) == "pre" {
+			pres = append(pres, n)
+		}
+		return false
+	})
+	if len(pres) != 2 {
+		return nil
+	}
+	var buf bytes.Buffer
+	pre(pres[0], &buf, &Option{})
+	if !lineNumbersRegex.MatchString(buf.String()) {
+		return nil
+	}
+	cell := pres[1]
+	for cell != nil && strings.ToLower(cell.Data) != "td" {
+		cell = cell.Parent
+	}
+	return cell
+}
+
+// Reports whether the node is glued to letters or digits of the surrounding text
+func isIntraword(node *html.Node) bool {
+	if prev := node.PrevSibling; prev != nil && prev.Type == html.TextNode && prev.Data != "" {
+		r := []rune(prev.Data)
+		if c := r[len(r)-1]; unicode.IsLetter(c) || unicode.IsDigit(c) {
+			return true
+		}
+	}
+	if next := node.NextSibling; next != nil && next.Type == html.TextNode && next.Data != "" {
+		if c := []rune(next.Data)[0]; unicode.IsLetter(c) || unicode.IsDigit(c) {
+			return true
+		}
+	}
+	return false
+}
+
+var backticksRegex = regexp.MustCompile("`+")
+
+// Wraps the text in backticks as a code span, keeping the spaces of the text
+// See: https://spec.commonmark.org/0.29/#code-spans
+func codeSpan(text string, option *Option) string {
+	if option.PlainText {
+		return text
+	}
+
+	// The fence must be longer than any run of backticks in the text
+	n := 0
+	for _, run := range backticksRegex.FindAllString(text, -1) {
+		if len(run) > n {
+			n = len(run)
+		}
+	}
+	fence := strings.Repeat("`", n+1)
+
+	// A backtick next to the fence would become a part of it, and a space
+	// at both ends would be stripped as the padding, so they are padded
+	padded := strings.HasPrefix(text, " ") && strings.HasSuffix(text, " ") && strings.Trim(text, " ") != ""
+	if padded || strings.HasPrefix(text, "`") || strings.HasSuffix(text, "`") {
+		text = " " + text + " "
+	}
+	return fence + text + fence
+}
+
+// In the spec, https://spec.commonmark.org/0.29/#delimiter-run
 // A  left-flanking delimiter run should not followed by Unicode whitespace
 // A  right-flanking delimiter run should not preceded by Unicode whitespace
 // This will wrap the delimiter (such as **) around the non-whitespace contents, but preserve the whitespace
 func aroundNonWhitespace(node *html.Node, w io.Writer, nest int, option *Option, before, after string) {
+	// Plain text has no delimiters at all
+	if option.PlainText {
+		walk(node, w, nest, option)
+		return
+	}
+
 	buf := &bytes.Buffer{}
 
 	walk(node, buf, nest, option)
 	s := buf.String()
 
+	// Delimiters can not span blocks, so each line of block contents is wrapped on its own,
+	// after the markers which start the blocks. Code blocks, tables and thematic breaks are kept as is.
+	if strings.Contains(strings.TrimSpace(s), "\n") {
+		lines := strings.Split(s, "\n")
+		fenced := false
+		for i, l := range lines {
+			if isFence(l) {
+				fenced = !fenced
+				continue
+			}
+			if fenced || strings.HasPrefix(strings.TrimSpace(l), "|") || thematicBreakRegex.MatchString(l) {
+				continue
+			}
+			marker := blockMarkerRegex.FindString(l)
+			lines[i] = marker + wrapNonWhitespace(l[len(marker):], before, after)
+		}
+		fmt.Fprint(w, strings.Join(lines, "\n"))
+		return
+	}
+
+	fmt.Fprint(w, wrapNonWhitespace(s, before, after))
+}
+
+// Renders the inline contents of the link on a single line, collapsing the line
+// breaks of br or of the source into spaces. The whitespace around the text is
+// put out of the link as a single space, unless the text next to it has one
+// or the link is at the edge of the block.
+func linkText(node *html.Node, nest int, option *Option, end string) string {
+	var buf bytes.Buffer
+	walk(node, &buf, nest, option)
+	s := buf.String()
+	text := strings.TrimSpace(lineBreakRegex.ReplaceAllString(s, " "))
+	if text == "" {
+		return s
+	}
+	text = "[" + text + end
+	inBlock := node.Parent != nil && (blockElements[strings.ToLower(node.Parent.Data)] || isBlockContainer(node.Parent))
+	// The line breaks at the edges of text are trimmed in rendering, so the source is checked too
+	leading := strings.TrimLeftFunc(s, unicode.IsSpace) != s ||
+		node.FirstChild != nil && node.FirstChild.Type == html.TextNode && strings.TrimLeftFunc(node.FirstChild.Data, unicode.IsSpace) != node.FirstChild.Data
+	trailing := strings.TrimRightFunc(s, unicode.IsSpace) != s ||
+		node.LastChild != nil && node.LastChild.Type == html.TextNode && strings.TrimRightFunc(node.LastChild.Data, unicode.IsSpace) != node.LastChild.Data
+	if leading {
+		prev := node.PrevSibling
+		if prev == nil && !inBlock || prev != nil && (prev.Type != html.TextNode || strings.TrimRightFunc(prev.Data, unicode.IsSpace) == prev.Data) {
+			text = " " + text
+		}
+	}
+	if trailing {
+		next := node.NextSibling
+		if next == nil && !inBlock || next != nil && (next.Type != html.TextNode || strings.TrimLeftFunc(next.Data, unicode.IsSpace) == next.Data) {
+			text += " "
+		}
+	}
+	return text
+}
+
+// Reports whether the node holds inline contents as a block, other than blockElements
+func isBlockContainer(node *html.Node) bool {
+	switch strings.ToLower(node.Data) {
+	case "li", "td", "th", "dt", "dd", "body":
+		return true
+	}
+	return false
+}
+
+// A regex to find the markers which start the blocks of the line, such as "> * " or "## "
+var blockMarkerRegex = regexp.MustCompile(`^(?:[ \t]*(?:(?:[*+-]|\d+[.)])[ \t]+(?:\[[ x]\][ \t]+)?|>[ \t]?|#{1,6}[ \t]+))+`)
+
+// A regex to detect thematic breaks, such as "---" or "* * *"
+var thematicBreakRegex = regexp.MustCompile(`^[ \t]*(?:(?:-[ \t]*){3,}|(?:\*[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+
+func wrapNonWhitespace(s, before, after string) string {
 	// If the contents are simply whitespace, return without adding any delimiters
 	if strings.TrimSpace(s) == "" {
-		fmt.Fprint(w, s)
-		return
+		return s
 	}
 
 	start := 0
@@ -267,9 +1710,240 @@ func aroundNonWhitespace(node *html.Node, w io.Writer, nest int, option *Option,
 		}
 	}
 
-	s = s[:start] + before + s[start:stop] + after + s[stop:]
+	return s[:start] + before + s[start:stop] + after + s[stop:]
+}
+
+// Reports whether the node is rendered as a code span
+func isCodeSpan(node *html.Node, option *Option) bool {
+	if node == nil || node.Type != html.ElementNode || isDescendantOf(node, "pre") {
+		return false
+	}
+	switch strings.ToLower(node.Data) {
+	case "code", "tt", "kbd":
+		return true
+	case "samp":
+		return option.SampMode != SampPlain
+	case "var":
+		return option.VarMode == VarCode
+	}
+	return false
+}
+
+// Gets what separates the code span from the one right before it, since
+// the backticks of adjacent code spans would run together such as
+//
+//	`a``b`
+func codeSpanBoundary(node *html.Node, option *Option) string {
+	if option.PlainText || !isCodeSpan(node.PrevSibling, option) {
+		return ""
+	}
+	return "<!-- -->"
+}
+
+// Renders code, kbd, samp, tt and var as a code span
+func inlineCode(node *html.Node, w io.Writer, option *Option) {
+	var buf bytes.Buffer
+	pre(node, &buf, option)
+	// Sample output of several lines does not fit in a code span
+	if text := strings.Trim(buf.String(), "\r\n"); strings.ToLower(node.Data) == "samp" && strings.Contains(text, "\n") {
+		br(node, w, option)
+		fmt.Fprint(w, codeBlock("", text, option)+"\n")
+		return
+	}
+	fmt.Fprint(w, codeSpanBoundary(node, option)+codeSpan(buf.String(), option))
+}
+
+// Renders the preformatted text of the node as a fenced code block
+func preBlock(node *html.Node, w io.Writer, option *Option) {
+	clone := option.Clone()
+	clone.doNotEscape = true
+
+	var buf bytes.Buffer
+	pre(node, &buf, clone)
+	inner := buf.String()
+	// The parser drops the newline right after <pre>, but not after other elements
+	if strings.ToLower(node.Data) != "pre" {
+		inner = strings.TrimPrefix(strings.TrimPrefix(inner, "\r"), "\n")
+	}
+	if !option.PreserveCodeTrailingSpace {
+		inner = strings.TrimRight(inner, " \t\r\n")
+	}
+
+	var lang string = langFromClass(node)
+	if lang == "" {
+		lang = langFromAncestors(node)
+	}
+	fromNode := ""
+	if option.LangFromNode != nil {
+		fromNode = option.LangFromNode(node)
+	}
+	if fromNode != "" {
+		lang = fromNode
+	} else if option != nil && option.GuessLang != nil {
+		if guess, err := option.GuessLang(buf.String()); err == nil {
+			lang = guess
+		}
+	}
+	if lang == "" {
+		lang = option.DefaultLang
+	}
+	if option.StripPromptMarkers && isShellSession(lang, inner) {
+		inner = promptRegex.ReplaceAllString(inner, "")
+	}
+
+	fmt.Fprint(w, codeBlock(lang, inner, option)+"\n")
+}
+
+var shellLangs = []string{"sh", "bash", "zsh", "shell", "console", "shell-session", "shellsession"}
+
+// A regex to find the prompts such as "$ " and "> " at the start of lines
+var promptRegex = regexp.MustCompile(`(?m)^[$>] `)
+
+// Reports whether the code is a shell session, by the language or,
+// without any language, by the prompt on the first line
+func isShellSession(lang, code string) bool {
+	if lang == "" {
+		return strings.HasPrefix(strings.TrimLeft(code, "\r\n"), "$ ")
+	}
+	for _, l := range shellLangs {
+		if strings.ToLower(lang) == l {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the whitespace of the node is kept by white-space: pre or pre-wrap
+func isPreformatted(node *html.Node) bool {
+	switch inlineStyle(node)["white-space"] {
+	case "pre", "pre-wrap":
+		return true
+	}
+	return false
+}
 
-	fmt.Fprint(w, s)
+// Reports whether the line opens or closes a fenced code block
+func isFence(line string) bool {
+	return strings.HasPrefix(strings.TrimLeft(line, " "), "```")
+}
+
+// Renders the code as a fenced code block, or as is in plain text
+func codeBlock(lang, code string, option *Option) string {
+	if !strings.HasSuffix(code, "\n") {
+		code += "\n"
+	}
+	if option.PlainText {
+		return code
+	}
+	fence := codeFence(code)
+	return fence + lang + "\n" + code + fence + "\n"
+}
+
+// Makes the fence of the code block, which must be longer than any run of
+// backticks in the code not to be closed by the code
+func codeFence(code string) string {
+	n := 2
+	for _, run := range backticksRegex.FindAllString(code, -1) {
+		if len(run) > n {
+			n = len(run)
+		}
+	}
+	return strings.Repeat("`", n+1)
+}
+
+// Renders the link in plain text as "text (url)", or just the text when
+// the URL adds nothing to it
+func link(node *html.Node, href string, w io.Writer, nest int, option *Option) {
+	var buf bytes.Buffer
+	walk(node, &buf, nest, option)
+	text := buf.String()
+	fmt.Fprint(w, text)
+	if href == "" || strings.HasPrefix(href, "#") || strings.TrimSpace(text) == href || strings.TrimSpace(text) == strings.TrimPrefix(href, "mailto:") {
+		return
+	}
+	fmt.Fprint(w, " ("+href+")")
+}
+
+var permalinkTexts = []string{"", "#", "¶", "§", "🔗"}
+
+// Reports whether the link is a permalink put in headings, such as
+// <a class="anchor" href="#usage"><svg ...></svg></a> of GitHub
+func isPermalink(node *html.Node) bool {
+	if !strings.HasPrefix(attr(node, "href"), "#") {
+		return false
+	}
+	var buf bytes.Buffer
+	pre(node, &buf, &Option{})
+	text := strings.TrimSpace(buf.String())
+	for _, t := range permalinkTexts {
+		if text == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Gets the number of the first item of the list, which is the start
+// attribute or 1. Markdown has no negative numbers of the items
+func listStart(node *html.Node) int {
+	if start, err := strconv.Atoi(strings.TrimSpace(attr(node, "start"))); err == nil && start >= 0 {
+		return start
+	}
+	return 1
+}
+
+// Gets the number of the first item of the reversed list, which is
+// the start attribute or the number of the items
+func reversedStart(node *html.Node) int {
+	if start, err := strconv.Atoi(strings.TrimSpace(attr(node, "start"))); err == nil {
+		return start
+	}
+	n := 0
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && strings.ToLower(c.Data) == "li" {
+			n++
+		}
+	}
+	return n
+}
+
+// Gets the checkbox which starts the list item of a task list, looking
+// through the labels and spans at the start
+func taskCheckbox(node *html.Node) *html.Node {
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.TextNode && strings.TrimSpace(c.Data) == "" {
+			continue
+		}
+		if c.Type == html.ElementNode && strings.ToLower(c.Data) == "input" && strings.ToLower(attr(c, "type")) == "checkbox" {
+			return c
+		}
+		// The checkbox may be wrapped in a label such as <label><input type="checkbox"> Done</label>,
+		// or in the paragraph of a loose list item
+		if c.Type == html.ElementNode && (strings.ToLower(c.Data) == "label" || strings.ToLower(c.Data) == "span" || strings.ToLower(c.Data) == "p") {
+			return taskCheckbox(c)
+		}
+		break
+	}
+	return nil
+}
+
+// A regex to find line breaks with the whitespace around them
+var lineBreakRegex = regexp.MustCompile(`[ \t]*[\r\n][[:space:]]*`)
+
+// A regex to collapse the consecutive breaks in table cells into one,
+// such as of br elements between paragraphs
+var cellBreakRegex = regexp.MustCompile(`[ \t]*<br>(?:[ \t]*<br>)*[ \t]*`)
+
+// Headings must be on a single line, so the contents are rendered and
+// every line break is collapsed into a space. Runs of spaces are kept,
+// since text collapses them already, but code spans must not.
+func heading(node *html.Node, nest int, option *Option) string {
+	clone := option.Clone()
+	clone.inHeading = true
+
+	var buf bytes.Buffer
+	walk(node, &buf, nest, clone)
+	return strings.TrimSpace(lineBreakRegex.ReplaceAllString(buf.String(), " "))
 }
 
 func walk(node *html.Node, w io.Writer, nest int, option *Option) {
@@ -278,12 +1952,18 @@ func walk(node *html.Node, w io.Writer, nest int, option *Option) {
 			return
 		}
 
-		text := regexp.MustCompile(`[[:space:]][[:space:]]*`).ReplaceAllString(strings.Trim(node.Data, "\t\r\n"), " ")
+		text := spaceRegex.ReplaceAllString(strings.Trim(node.Data, "\t\r\n"), " ")
 
-		if !option.doNotEscape {
-			text = escapeRegex.ReplaceAllStringFunc(text, func(str string) string {
-				return `\` + str
-			})
+		if !option.doNotEscape && option.inHeading && option.MinimalHeadingEscape {
+			text = escapeHeading(text, startsWithLink(node.NextSibling))
+		} else if !option.doNotEscape {
+			text = escape(text)
+			if !option.NoEscapeListStarts {
+				text = listStartRegex.ReplaceAllString(text, `$1\.$2`)
+			}
+		}
+		if option.noWrap {
+			text = strings.Replace(text, " ", noWrapSpace, -1)
 		}
 		fmt.Fprint(w, text)
 	}
@@ -293,79 +1973,285 @@ func walk(node *html.Node, w io.Writer, nest int, option *Option) {
 		italicChar = "*"
 	}
 
+	strike := option.StrikethroughMarker
+	if strike == "" {
+		strike = "~~"
+	}
+
 	n := 0
 	for c := node.FirstChild; c != nil; c = c.NextSibling {
 		switch c.Type {
 		case html.CommentNode:
-			if option.IgnoreComments {
+			if option.IgnoreComments || option.PlainText || conditionalCommentRegex.MatchString(c.Data) {
+				drop("comment", c, option)
 				break
 			}
 			fmt.Fprint(w, "<!--")
 			fmt.Fprint(w, c.Data)
 			fmt.Fprint(w, "-->\n")
 		case html.ElementNode:
+			if option.DropAriaHidden && strings.ToLower(attr(c, "aria-hidden")) == "true" {
+				drop("aria-hidden", c, option)
+				break
+			}
+
 			customWalk, ok := option.customRulesMap[strings.ToLower(c.Data)]
 			if ok {
 				customWalk(c, w, nest, option)
 				break
 			}
 
+			if tmpl, ok := option.Shortcodes[strings.ToLower(c.Data)]; ok {
+				br(c, w, option)
+				fmt.Fprint(w, shortcode(c, tmpl)+"\n\n")
+				break
+			}
+
+			// Alerts of GitHub are blockquotes starting with "> [!NOTE]"
+			if typ := alertType(c, option); typ != "" && !option.PlainText {
+				br(c, w, option)
+				var buf bytes.Buffer
+				walk(c, &buf, nest+1, option)
+				fmt.Fprint(w, "> [!"+typ+"]\n")
+				quote(buf.String(), w, option)
+				break
+			}
+
+			if option.KeepStyledElements && isStyledElement(c) {
+				styledElement(c, w, nest, option)
+				break
+			}
+
 			switch strings.ToLower(c.Data) {
 			case "a":
+				if option.inHeading && isPermalink(c) {
+					drop("permalink in heading", c, option)
+					break
+				}
 				// Links are invalid in markdown if the link text extends beyond a single line
 				// So we render the contents and strip any spaces
 				href := attr(c, "href")
+				if href != "" {
+					// The link is dropped, but not the text, when the URL is rewritten to nothing
+					if href = rewriteURL("link", href, option); href == "" {
+						drop("link rewritten to nothing", c, option)
+						walk(c, w, nest, option)
+						break
+					}
+				}
+				if option.PlainText {
+					link(c, href, w, nest, option)
+					break
+				}
 				end := fmt.Sprintf("](%s)", href)
 				title := attr(c, "title")
 				if title != "" {
 					end = fmt.Sprintf("](%s %q)", href, title)
 				}
-				aroundNonWhitespace(c, w, nest, option, "[", end)
+				if option.LinkStyle == ReferenceLink && href != "" {
+					var text bytes.Buffer
+					pre(c, &text, &Option{})
+					end = fmt.Sprintf("][%s]", option.refs.add("", text.String(), href, title))
+				}
+				if label := attr(c, "aria-label"); option.UseAriaLabels && label != "" {
+					var buf bytes.Buffer
+					walk(c, &buf, nest, option)
+					if strings.TrimSpace(buf.String()) == "" {
+						if !option.doNotEscape {
+							label = escape(label)
+						}
+						fmt.Fprint(w, "["+label+end)
+						break
+					}
+				}
+				if hasBlock(c) {
+					aroundNonWhitespace(c, w, nest, option, "[", end)
+					break
+				}
+				fmt.Fprint(w, linkText(c, nest, option, end))
 			case "b", "strong":
 				aroundNonWhitespace(c, w, nest, option, "**", "**")
+			case "spacer":
+				// spacer is a void element in legacy HTML, but the parser puts
+				// the following content inside it, so only the element itself is dropped
+				walk(c, w, nest, option)
+			case "span":
+				// The TeX in <span class="math">$x^2$</span> must not be escaped
+				if option.MathMode == MathTeX && hasClass(c, "math") {
+					pre(c, w, option)
+					break
+				}
+				if option.inWrap && inlineStyle(c)["white-space"] == "nowrap" {
+					clone := option.Clone()
+					clone.noWrap = true
+					walk(c, w, nest, clone)
+					break
+				}
+				walk(c, w, nest, option)
+			case "time":
+				// The datetime must stay on a single line, like in table cells
+				datetime := strings.TrimSpace(spaceRegex.ReplaceAllString(attr(c, "datetime"), " "))
+				if datetime == "" || option.TimeMode == TimeText {
+					walk(c, w, nest, option)
+					break
+				}
+				if !option.doNotEscape {
+					datetime = escape(datetime)
+				}
+				if option.TimeMode == TimeDatetime {
+					fmt.Fprint(w, datetime)
+				} else if option.doNotEscape {
+					walk(c, w, nest, option)
+					fmt.Fprint(w, " ("+datetime+")")
+				} else {
+					walk(c, w, nest, option)
+					fmt.Fprint(w, " \\("+datetime+"\\)")
+				}
+			case "sub", "sup":
+				switch option.SubSupMode {
+				case SubSupHTML:
+					raw(c, w, option)
+				case SubSupPandoc:
+					// The delimiters are glued to the text around them, as in H~2~O,
+					// and spaces inside must be escaped
+					delim := "~"
+					if strings.ToLower(c.Data) == "sup" {
+						delim = "^"
+					}
+					var buf bytes.Buffer
+					walk(c, &buf, nest, option)
+					if text := strings.TrimSpace(buf.String()); text != "" {
+						fmt.Fprint(w, delim+strings.Replace(text, " ", `\ `, -1)+delim)
+					}
+				default:
+					walk(c, w, nest, option)
+				}
+			case "abbr":
+				title := strings.TrimSpace(spaceRegex.ReplaceAllString(attr(c, "title"), " "))
+				walk(c, w, nest, option)
+				if title == "" || option.AbbrMode == AbbrText {
+					break
+				}
+				if !option.doNotEscape {
+					fmt.Fprint(w, " \\("+escape(title)+"\\)")
+					break
+				}
+				// Brackets would end the text of the link around the abbr
+				if isDescendantOf(c, "a") {
+					title = strings.NewReplacer("[", `\[`, "]", `\]`).Replace(title)
+				}
+				fmt.Fprint(w, " ("+title+")")
+			case "nobr":
+				clone := option.Clone()
+				clone.noWrap = option.inWrap
+				walk(c, w, nest, clone)
+			case "blink", "marquee":
+				walk(c, w, nest, option)
+			case "big":
+				if option.EmphasizeBig {
+					aroundNonWhitespace(c, w, nest, option, "**", "**")
+				} else {
+					walk(c, w, nest, option)
+				}
+			case "q", "cite":
+				// Blockquotes would break table cells, headings and the paragraphs of list items
+				if option.LongQuoteLength > 0 && !option.inTableCell && !option.inHeading &&
+					!isDescendantOf(c, "li") && !isDescendantOf(c, "dd") {
+					var buf bytes.Buffer
+					walk(c, &buf, nest, option)
+					if text := strings.TrimSpace(spaceRegex.ReplaceAllString(buf.String(), " ")); utf8.RuneCountInString(text) > option.LongQuoteLength {
+						fmt.Fprint(w, "\n\n> "+text+"\n\n")
+						break
+					}
+				}
+				if strings.ToLower(c.Data) == "q" {
+					aroundNonWhitespace(c, w, nest, option, `"`, `"`)
+					// A link inside the link would be nested, which Markdown does not allow
+					if cite := rewriteURL("link", attr(c, "cite"), option); option.QuoteCiteLinks && cite != "" && !isDescendantOf(c, "a") {
+						if option.PlainText {
+							fmt.Fprint(w, " ("+cite+")")
+						} else {
+							fmt.Fprintf(w, " ([source](%s))", cite)
+						}
+					}
+				} else {
+					aroundNonWhitespace(c, w, nest, option, italicChar, italicChar)
+				}
 			case "i", "em":
-				aroundNonWhitespace(c, w, nest, option, italicChar, italicChar)
-			case "del", "s":
-				aroundNonWhitespace(c, w, nest, option, "~~", "~~")
+				// _ does not work inside words, so fall back to * there
+				if italicChar == "_" && isIntraword(c) {
+					aroundNonWhitespace(c, w, nest, option, "*", "*")
+				} else {
+					aroundNonWhitespace(c, w, nest, option, italicChar, italicChar)
+				}
+			case "del", "ins":
+				if option.EditMode == HTMLEdits {
+					raw(c, w, option)
+				} else if strings.ToLower(c.Data) == "del" && hasBlock(c) && !option.inTableCell {
+					// Strikethrough can not span blocks such as lists
+					keepTags(c, w, nest, option, true)
+				} else if strings.ToLower(c.Data) == "del" {
+					aroundNonWhitespace(c, w, nest, option, strike, strike)
+				} else {
+					walk(c, w, nest, option)
+				}
+			case "s":
+				aroundNonWhitespace(c, w, nest, option, strike, strike)
 			case "br":
+				max := option.MaxBreaks
+				if max <= 0 {
+					max = 1
+				}
+				if breaksBefore(c) >= max {
+					break
+				}
+				// Rows of tables must be on a single line
+				if option.inTableCell {
+					if option.PlainText {
+						fmt.Fprint(w, " ")
+					} else {
+						fmt.Fprint(w, "<br>")
+					}
+					break
+				}
 				br(c, w, option)
 				fmt.Fprint(w, "\n\n")
 			case "p":
 				br(c, w, option)
-				walk(c, w, nest, option)
+				if option.MaxLineWidth > 0 && !option.inHeading && !option.inTableCell {
+					clone := option.Clone()
+					clone.inWrap = true
+					var buf bytes.Buffer
+					walk(c, &buf, nest, clone)
+					fmt.Fprint(w, wrapLines(buf.String(), option.MaxLineWidth))
+				} else {
+					walk(c, w, nest, option)
+				}
 				br(c, w, option)
 				fmt.Fprint(w, "\n\n")
-			case "code":
-				if !isChildOf(c, "pre") {
-					fmt.Fprint(w, "`")
+			case "var":
+				if option.VarMode == VarCode {
+					inlineCode(c, w, option)
+				} else {
+					aroundNonWhitespace(c, w, nest, option, italicChar, italicChar)
+				}
+			case "code", "tt", "kbd", "samp":
+				if strings.ToLower(c.Data) == "samp" && option.SampMode == SampPlain {
+					walk(c, w, nest, option)
+				} else if isDescendantOf(c, "pre") {
 					pre(c, w, option)
-					fmt.Fprint(w, "`")
+				} else {
+					inlineCode(c, w, option)
 				}
 			case "pre":
 				br(c, w, option)
-
-				clone := option.Clone()
-				clone.doNotEscape = true
-
-				var buf bytes.Buffer
-				pre(c, &buf, clone)
-				inner := buf.String()
-
-				var lang string = langFromClass(c)
-				if option != nil && option.GuessLang != nil {
-					if guess, err := option.GuessLang(buf.String()); err == nil {
-						lang = guess
-					}
-				}
-
-				fmt.Fprint(w, "```"+lang+"\n")
-				fmt.Fprint(w, inner)
-				if !strings.HasSuffix(inner, "\n") {
-					fmt.Fprint(w, "\n")
-				}
-				fmt.Fprint(w, "```\n\n")
+				preBlock(c, w, option)
 			case "div":
 				br(c, w, option)
+				if isPreformatted(c) {
+					preBlock(c, w, option)
+					break
+				}
 				walk(c, w, nest, option)
 				fmt.Fprint(w, "\n")
 			case "blockquote":
@@ -379,21 +2265,37 @@ func walk(node *html.Node, w io.Writer, nest int, option *Option) {
 							lang = guess
 						}
 					}
-					fmt.Fprint(w, "```"+lang+"\n")
-					fmt.Fprint(w, strings.TrimLeft(buf.String(), "\n"))
-					if !strings.HasSuffix(buf.String(), "\n") {
-						fmt.Fprint(w, "\n")
+					if lang == "" {
+						lang = option.DefaultLang
 					}
-					fmt.Fprint(w, "```\n\n")
+					fmt.Fprint(w, codeBlock(lang, strings.TrimLeft(buf.String(), "\n"), option)+"\n")
 				} else {
+					var attribution string
+					if cite := trailingCite(c); cite != nil && option.BlockquoteCiteAttribution && !option.PlainText {
+						var citeBuf bytes.Buffer
+						walk(cite, &citeBuf, nest+1, option)
+						attribution = strings.TrimSpace(spaceRegex.ReplaceAllString(citeBuf.String(), " "))
+						// The dash before the cite is replaced by the one of the attribution
+						if prev := cite.PrevSibling; prev != nil && prev.Type == html.TextNode && strings.Trim(prev.Data, " \t\r\n-—―~") == "" {
+							prev.Parent.RemoveChild(prev)
+						}
+						cite.Parent.RemoveChild(cite)
+					}
 					walk(c, &buf, nest+1, option)
-
-					if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) > 0 {
-						for _, l := range lines {
-							fmt.Fprint(w, "> "+strings.TrimSpace(l)+"\n")
+					// The following blockquotes are taken out of the tree
+					// not to be rendered again
+					for next := adjacentBlockquote(c, option); next != nil; next = adjacentBlockquote(c, option) {
+						for c.NextSibling != next {
+							c.Parent.RemoveChild(c.NextSibling)
 						}
-						fmt.Fprint(w, "\n")
+						c.Parent.RemoveChild(next)
+						buf.WriteString("\n\n")
+						walk(next, &buf, nest+1, option)
 					}
+					if attribution != "" {
+						buf.WriteString("\n\n— " + attribution)
+					}
+					quote(buf.String(), w, option)
 				}
 			case "ul", "ol":
 				br(c, w, option)
@@ -401,13 +2303,25 @@ func walk(node *html.Node, w io.Writer, nest int, option *Option) {
 				newOption := option.Clone()
 				newOption.TrimSpace = true
 
+				// A list put in a list without li, which malformed HTML has, is a sublist
+				// of the item before it, or it continues the list when there is none
+				level := nest + 1
+				if (isChildOf(c, "ul") || isChildOf(c, "ol")) && prevItem(c) == nil {
+					level = nest
+				}
+
 				var buf bytes.Buffer
-				walk(c, &buf, nest+1, newOption)
+				walk(c, &buf, level, newOption)
 
-				// Remove any empty lines in the list
+				// Remove any empty lines in the list, but keep the indented
+				// blank lines which list items put between their blocks
 				if lines := strings.Split(buf.String(), "\n"); len(lines) > 0 {
+					fenced := false
 					for i, l := range lines {
-						if strings.TrimSpace(l) == "" {
+						if isFence(l) {
+							fenced = !fenced
+						}
+						if l == "" && !(fenced && option.PreserveListIndent) {
 							continue
 						}
 
@@ -427,30 +2341,83 @@ func walk(node *html.Node, w io.Writer, nest int, option *Option) {
 
 				var buf bytes.Buffer
 				walk(c, &buf, 0, option)
+				// The checkbox is consumed, and so is the space after it
+				if box := taskCheckbox(c); box != nil {
+					task := "[ ] "
+					if hasAttr(box, "checked") {
+						task = "[x] "
+					}
+					if option.PlainText {
+						task = ""
+					} else if option.TaskListMode == TaskListHTML {
+						var tag bytes.Buffer
+						raw(box, &tag, option)
+						task = tag.String() + " "
+					}
+					text := strings.TrimLeft(buf.String(), " ")
+					buf.Reset()
+					buf.WriteString(task + text)
+				}
 
 				markPrinted := false
-
+				spacing := strings.Repeat(" ", option.listMarkerSpacing())
+				marker := ""
+				if isChildOf(c, "ul") {
+					// Plain text keeps only the indentation of the items
+					if !option.PlainText {
+						marker = option.bulletChar() + spacing
+					}
+				} else if isChildOf(c, "ol") {
+					number := listStart(c.Parent) + n
+					if hasAttr(c.Parent, "reversed") {
+						// Markdown has no negative numbers of the items, so the count stops at 0
+						number = reversedStart(c.Parent) - n
+						if number < 0 {
+							number = 0
+						}
+					}
+					marker = fmt.Sprintf("%d.", number) + spacing
+				}
+				indent := option.listIndent(marker)
+
+				// Terms of definition lists must follow a blank line, or they become
+				// a part of the paragraph before them, and so must the contents of details
+				// to end the HTML block
+				loose := findElement(c, func(n *html.Node) bool {
+					name := strings.ToLower(n.Data)
+					return name == "dl" || name == "details"
+				}) != nil
+				blank := false
+
+				fenced := false
 				for _, l := range strings.Split(buf.String(), "\n") {
+					if isFence(l) {
+						fenced = !fenced
+					}
 					if strings.TrimSpace(l) == "" {
+						// Blank lines of code blocks are a part of the code
+						if fenced && markPrinted && option.PreserveListIndent {
+							fmt.Fprint(w, "\n")
+							continue
+						}
+						blank = markPrinted && loose
 						continue
 					}
-					// if markPrinted {
-
-					// }
+					if blank {
+						fmt.Fprint(w, "\n"+strings.Repeat(indent, nest))
+						blank = false
+					}
 					if markPrinted {
-						fmt.Fprint(w, "\n    ")
+						fmt.Fprint(w, "\n"+indent)
 					}
 
-					fmt.Fprint(w, strings.Repeat("    ", nest-1))
+					fmt.Fprint(w, strings.Repeat(indent, nest-1))
 
 					if !markPrinted {
-						if isChildOf(c, "ul") {
-							fmt.Fprint(w, "* ")
-						} else if isChildOf(c, "ol") {
+						if isChildOf(c, "ol") {
 							n++
-							fmt.Fprint(w, fmt.Sprintf("%d. ", n))
 						}
-
+						fmt.Fprint(w, marker)
 						markPrinted = true
 					}
 
@@ -459,47 +2426,194 @@ func walk(node *html.Node, w io.Writer, nest int, option *Option) {
 
 				fmt.Fprint(w, "\n")
 
+			case "dl":
+				br(c, w, option)
+				// The first term must not continue the text before the list
+				if prev := prevSibling(c); prev != nil && prev.Type == html.TextNode {
+					fmt.Fprint(w, "\n\n")
+				}
+				dl(c, w, nest, option)
 			case "h1", "h2", "h3", "h4", "h5", "h6":
+				level := int(rune(c.Data[1]) - rune('0'))
+				// The definitions of the section end it, before the next h1 or h2
+				if option.ReferencesPerSection && level <= 2 && isTopLevel(c) && len(option.refs.defs) > option.refs.written {
+					option.refs.write(w)
+					fmt.Fprint(w, "\n")
+				}
 				br(c, w, option)
-				fmt.Fprint(w, strings.Repeat("#", int(rune(c.Data[1])-rune('0')))+" ")
-				walk(c, w, nest, option)
+				// Headings deeper than the limit are flattened to bold paragraphs
+				if option.MaxHeadingLevel > 0 && level > option.MaxHeadingLevel {
+					text := heading(c, nest, option)
+					if !option.PlainText && text != "" {
+						text = "**" + text + "**"
+					}
+					fmt.Fprint(w, text+"\n\n")
+					break
+				}
+				text := heading(c, nest, option)
+				if option.NumberHeadings {
+					text = option.sections.number(level) + " " + text
+				}
+				// The underline is as wide as the text, and empty headings
+				// cannot be in the Setext style
+				if option.HeadingStyle == SetextHeading && level <= 2 && !option.PlainText && strings.TrimSpace(text) != "" {
+					underline := "="
+					if level == 2 {
+						underline = "-"
+					}
+					fmt.Fprint(w, text+"\n"+strings.Repeat(underline, runewidth.StringWidth(text))+"\n\n")
+					break
+				}
+				if !option.PlainText {
+					fmt.Fprint(w, strings.Repeat("#", level)+" ")
+				}
+				fmt.Fprint(w, text)
 				fmt.Fprint(w, "\n\n")
 			case "img":
-				src := attr(c, "src")
-				alt := attr(c, "alt")
-				title := attr(c, "title")
-
-				if src == "" {
+				image(c, attr(c, "src"), w, option)
+			case "object", "embed":
+				if option.EmbedMode == EmbedHTML {
+					raw(c, w, option)
 					break
 				}
-
-				full := fmt.Sprintf("![%s](%s)", alt, src)
-				if title != "" {
-					full = fmt.Sprintf("![%s](%s %q)", alt, src, title)
+				if option.EmbedMode == EmbedLink {
+					embedLink(c, w, option)
+					break
 				}
-
-				fmt.Fprint(w, full)
+				drop(strings.ToLower(c.Data)+" replaced by the fallback", c, option)
+				walk(c, w, nest, option)
+			case "video":
+				if option.EmbedMode == EmbedHTML {
+					raw(c, w, option)
+					break
+				}
+				if attr(c, "poster") != "" && !option.PlainText {
+					videoPoster(c, w, option)
+					break
+				}
+				drop("video replaced by the fallback", c, option)
+				walk(c, w, nest, option)
+			case "noembed":
+				// The fallback is needed only when embeds are dropped
+				if option.EmbedMode == EmbedHTML {
+					drop("noembed", c, option)
+					break
+				}
+				// The contents of noembed are parsed as raw text, so they are parsed again as HTML
+				var buf bytes.Buffer
+				pre(c, &buf, &Option{})
+				if doc, err := html.Parse(&buf); err == nil {
+					walk(doc, w, nest, option)
+				}
+			case "select":
+				if !option.Forms {
+					walk(c, w, nest, option)
+					break
+				}
+				br(c, w, option)
+				selectList(c, w, option)
+			case "datalist":
+				// The options of datalist are only the suggestions for the input
+				if !option.Forms {
+					drop("datalist", c, option)
+					break
+				}
+				br(c, w, option)
+				if label := datalistLabel(c, option); label != "" {
+					fmt.Fprint(w, label+"\n\n")
+				}
+				selectList(c, w, option)
+			case "details":
+				br(c, w, option)
+				details(c, w, nest, option)
+			case "summary":
+				// The summary of details is rendered apart from the contents,
+				// and the one out of details is rendered as a bold line
+				if isChildOf(c, "details") {
+					break
+				}
+				br(c, w, option)
+				aroundNonWhitespace(c, w, nest, option, "**", "**")
+				fmt.Fprint(w, "\n\n")
+			case "figure":
+				br(c, w, option)
+				figure(c, w, nest, option)
+			case "math":
+				if option.MathMode == MathTeX {
+					if tex := texAnnotation(c); tex != "" {
+						if attr(c, "display") == "block" {
+							br(c, w, option)
+							fmt.Fprint(w, "$$"+tex+"$$\n\n")
+						} else {
+							fmt.Fprint(w, "$"+tex+"$")
+						}
+						break
+					}
+				}
+				if option.MathMode != MathText {
+					raw(c, w, option)
+					break
+				}
+				walk(c, w, nest, option)
+			case "picture":
+				if src := pictureSource(c, option.PreferredViewport); src != "" {
+					if img := findElement(c, func(n *html.Node) bool { return strings.ToLower(n.Data) == "img" }); img != nil {
+						image(img, src, w, option)
+						break
+					}
+				}
+				walk(c, w, nest, option)
 			case "hr":
 				br(c, w, option)
-				fmt.Fprint(w, "\n---\n\n")
+				// Plain text has a blank line for the break
+				if option.PlainText {
+					fmt.Fprint(w, "\n\n")
+					break
+				}
+				marker := option.HRMarker
+				if marker == "" {
+					marker = "---"
+				}
+				fmt.Fprint(w, "\n"+marker+"\n\n")
 			case "table":
 				br(c, w, option)
+				if option.TableMode == HTMLTable {
+					raw(c, w, option)
+					fmt.Fprint(w, "\n\n")
+					break
+				}
+				if option.StripLineNumbers {
+					if code := lineNumberedCode(c); code != nil {
+						walk(code, w, nest, option)
+						break
+					}
+				}
 				table(c, w, option)
 			case "style":
 				if option != nil && option.Style {
 					br(c, w, option)
 					raw(c, w, option)
 					fmt.Fprint(w, "\n\n")
+				} else {
+					drop("style", c, option)
 				}
 			case "script":
 				if option != nil && option.Script {
 					br(c, w, option)
 					raw(c, w, option)
 					fmt.Fprint(w, "\n\n")
+				} else {
+					drop("script", c, option)
 				}
 			default:
 				walk(c, w, nest, option)
 			}
+		case html.TextNode:
+			// Whitespace between line breaks would get in the way of collapsing them
+			if strings.TrimSpace(c.Data) == "" && isBreak(c.PrevSibling) && isBreak(c.NextSibling) {
+				break
+			}
+			walk(c, w, nest, option)
 		default:
 			walk(c, w, nest, option)
 		}
@@ -521,17 +2635,362 @@ type CustomRule interface {
 	Rule(next WalkFunc) (tagName string, customRule WalkFunc)
 }
 
+// LinkStyle is a style to render links and images.
+type LinkStyle int
+
+const (
+	// InlineLink renders links as [text](url)
+	InlineLink LinkStyle = iota
+	// ReferenceLink renders links as [text][1] with the definitions at the end
+	ReferenceLink
+)
+
+// TableMode is a mode to render tables.
+type TableMode int
+
+const (
+	// MarkdownTable renders tables as GFM tables
+	MarkdownTable TableMode = iota
+	// HTMLTable keeps tables as raw HTML
+	HTMLTable
+)
+
+// EditMode is a mode to render del and ins.
+type EditMode int
+
+const (
+	// StrikeEdits renders del as ~~text~~ and ins as plain text
+	StrikeEdits EditMode = iota
+	// HTMLEdits keeps del and ins as raw HTML with their cite and datetime
+	HTMLEdits
+)
+
+// MathMode is a mode to render math.
+type MathMode int
+
+const (
+	// MathText renders the text of MathML as is
+	MathText MathMode = iota
+	// MathHTML keeps MathML as raw HTML
+	MathHTML
+	// MathTeX renders the TeX annotation of MathML as $...$ or $$...$$,
+	// keeping MathML without the annotation as raw HTML
+	MathTeX
+)
+
+// Dialect is a preset of options for a flavor of Markdown.
+// Fields of Option left at their zero value take the defaults of the dialect.
+type Dialect int
+
+const (
+	// NoDialect uses the options as is
+	NoDialect Dialect = iota
+	// GitHub renders math as TeX, along with the task lists and tables rendered by default
+	GitHub
+	// CommonMark keeps tables, edits and task list checkboxes, which are extensions, as raw HTML
+	CommonMark
+	// Pandoc renders sub, sup, math and the dimensions of images in the syntax of Pandoc
+	Pandoc
+	// Obsidian renders math as TeX and the dimensions of images in the syntax of Obsidian
+	Obsidian
+)
+
+// TaskListMode is a mode to render the checkboxes starting list items.
+type TaskListMode int
+
+const (
+	// TaskListChecks renders the checkboxes as [ ] and [x] of task lists
+	TaskListChecks TaskListMode = iota
+	// TaskListHTML keeps the checkboxes as raw HTML, for Markdown without task lists
+	TaskListHTML
+)
+
+// VarMode is a mode to render var.
+type VarMode int
+
+const (
+	// VarItalic renders var as italic
+	VarItalic VarMode = iota
+	// VarCode renders var as inline code
+	VarCode
+)
+
+// SampMode is a mode to render samp.
+type SampMode int
+
+const (
+	// SampCode renders samp as inline code
+	SampCode SampMode = iota
+	// SampPlain renders samp as plain text
+	SampPlain
+)
+
+// TimeMode is a mode to render time.
+type TimeMode int
+
+const (
+	// TimeText renders the text of time
+	TimeText TimeMode = iota
+	// TimeDatetime renders the datetime attribute of time instead of the text
+	TimeDatetime
+	// TimeAppend renders the datetime attribute in parentheses after the text
+	TimeAppend
+)
+
+// FinalNewline is a mode to end the document.
+type FinalNewline int
+
+const (
+	// DoubleNewline appends a newline to the blank lines the blocks end with
+	DoubleNewline FinalNewline = iota
+	// SingleNewline ends the document with a single newline
+	SingleNewline
+	// NoNewline ends the document without any newline
+	NoNewline
+)
+
+// HeadingStyle is a style of headings.
+type HeadingStyle int
+
+const (
+	// ATXHeading renders headings with the leading # such as "# Title"
+	ATXHeading HeadingStyle = iota
+	// SetextHeading underlines h1 with === and h2 with ---, and renders
+	// the other headings in the ATX style
+	SetextHeading
+)
+
+// SubSupMode is a mode to render sub and sup.
+type SubSupMode int
+
+const (
+	// SubSupText renders the text of sub and sup
+	SubSupText SubSupMode = iota
+	// SubSupPandoc renders sub as ~text~ and sup as ^text^ of Pandoc
+	SubSupPandoc
+	// SubSupHTML keeps sub and sup as raw HTML
+	SubSupHTML
+)
+
+// ImageSizeMode is a mode to render the width and height of img.
+type ImageSizeMode int
+
+const (
+	// ImageSizeNone drops the width and height
+	ImageSizeNone ImageSizeMode = iota
+	// ImageSizePandoc renders the width and height as {width=100 height=50} of Pandoc
+	ImageSizePandoc
+	// ImageSizeObsidian renders the width and height as ![alt|100x50](src) of Obsidian
+	ImageSizeObsidian
+)
+
+// AbbrMode is a mode to render abbr.
+type AbbrMode int
+
+const (
+	// AbbrText renders the text of abbr
+	AbbrText AbbrMode = iota
+	// AbbrExpand renders the title attribute in parentheses after the text
+	AbbrExpand
+)
+
+// EmbedMode is a mode to render object, embed and video.
+type EmbedMode int
+
+const (
+	// EmbedFallback drops object and embed, rendering the fallback contents and noembed,
+	// and renders video with a poster as the poster linking to the video
+	EmbedFallback EmbedMode = iota
+	// EmbedLink renders object and embed as links to their data or src,
+	// and video as EmbedFallback does
+	EmbedLink
+	// EmbedHTML keeps object, embed and video as raw HTML, dropping noembed
+	EmbedHTML
+)
+
+// Used to count the headings of each level to number sections
+type sections [6]int
+
+// Counts the heading of the level and returns its number such as "1.2"
+func (s *sections) number(level int) string {
+	s[level-1]++
+	for i := level; i < len(s); i++ {
+		s[i] = 0
+	}
+	// Levels above the first heading of the document are left out
+	first := 0
+	for first < level-1 && s[first] == 0 {
+		first++
+	}
+	var nums []string
+	for _, n := range s[first:level] {
+		nums = append(nums, strconv.Itoa(n))
+	}
+	return strings.Join(nums, ".")
+}
+
+type reference struct {
+	prefix string
+	label  string
+	url    string
+	title  string
+}
+
+// Used to collect the definitions of reference-style links and images
+type references struct {
+	defs    []reference
+	named   bool // Used to derive the labels from the text instead of numbering them
+	sorted  bool // Used to write the definitions sorted by URL
+	written int  // Used to know the definitions already written
+}
+
+var slugRegex = regexp.MustCompile(`[^\pL\pN]+`)
+
+// Returns the label derived from the text such as "foo-bar", unique among the definitions
+func (r *references) slug(prefix, text string) string {
+	label := strings.Trim(slugRegex.ReplaceAllString(strings.ToLower(text), "-"), "-")
+	if label == "" {
+		return ""
+	}
+	if prefix != "" {
+		label = prefix + "-" + label
+	}
+	unique := label
+	for i := 2; ; i++ {
+		taken := false
+		for _, def := range r.defs {
+			if def.label == unique {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			return unique
+		}
+		unique = fmt.Sprintf("%s-%d", label, i)
+	}
+}
+
+// Returns the label of the definition for url and title, adding a new one if needed
+func (r *references) add(prefix, text, url, title string) string {
+	n := 0
+	for _, def := range r.defs {
+		if def.prefix != prefix {
+			continue
+		}
+		if def.url == url && def.title == title {
+			return def.label
+		}
+		n++
+	}
+	def := reference{prefix: prefix, label: fmt.Sprintf("%s%d", prefix, n+1), url: url, title: title}
+	if r.named {
+		if label := r.slug(prefix, text); label != "" {
+			def.label = label
+		}
+	}
+	r.defs = append(r.defs, def)
+	return def.label
+}
+
+// Writes the definitions added since the last write
+func (r *references) write(w io.Writer) {
+	defs := r.defs[r.written:]
+	r.written = len(r.defs)
+	if r.sorted {
+		defs = append([]reference(nil), defs...)
+		sort.SliceStable(defs, func(i, j int) bool { return defs[i].url < defs[j].url })
+	}
+	for _, def := range defs {
+		if def.title != "" {
+			fmt.Fprintf(w, "[%s]: %s %q\n", def.label, def.url, def.title)
+		} else {
+			fmt.Fprintf(w, "[%s]: %s\n", def.label, def.url)
+		}
+	}
+}
+
 // Option is optional information for Convert.
 type Option struct {
-	GuessLang      func(string) (string, error)
-	Script         bool
-	Style          bool
-	TrimSpace      bool
-	CustomRules    []CustomRule
-	IgnoreComments bool
-	ItalicsAsterix bool // Used to know if to use _ or * for italics
-	doNotEscape    bool // Used to know if to escape certain characters
-	customRulesMap map[string]WalkFunc
+	GuessLang                 func(string) (string, error)
+	RootSelector              string                      // Used to convert only the first element matching, such as "main, article", falling back to the whole document
+	FinalNewline              FinalNewline                // Used to end the document with the blank lines of blocks, a single newline or none
+	HeadingStyle              HeadingStyle                // Used to render headings as "# Title" or underlined with === and ---
+	Verbatim                  bool                        // Used to write the input HTML as is in a fenced code block, without any conversion
+	Charset                   string                      // Used to transcode the input to UTF-8, detected from the BOM or the meta tag if empty
+	LangFromNode              func(pre *html.Node) string // Used to get the language of code blocks from the DOM, before GuessLang
+	Forms                     bool                        // Used to render the options of select and the suggestions of datalist as lists
+	Script                    bool
+	Style                     bool
+	VerbatimScripts           bool // Used to keep script and style byte-exact as in the input
+	TrimSpace                 bool
+	CustomRules               []CustomRule
+	IgnoreComments            bool
+	ItalicsAsterix            bool   // Used to know if to use _ or * for italics
+	PreserveCodeTrailingSpace bool   // Used to keep trailing blank lines in code blocks
+	DefaultLang               string // Used for code blocks when no language is detected
+	LinkStyle                 LinkStyle
+	SeparateImageReferences   bool                                      // Used to number image references apart from links
+	ReferencesPerSection      bool                                      // Used to write reference definitions at the end of each section before h1 and h2
+	NamedReferences           bool                                      // Used to derive reference labels from the link text instead of numbers
+	SortReferences            bool                                      // Used to sort reference definitions by URL instead of the first-seen order
+	ImageMaps                 bool                                      // Used to render the areas of image maps as links
+	DropAriaHidden            bool                                      // Used to drop decorative elements with aria-hidden="true"
+	EmbedImages               bool                                      // Used to embed local images as data URIs read by FileResolver
+	FileResolver              func(path string) ([]byte, string, error) // Used to read the local image of the relative path and its MIME type
+	ImageAltFallback          bool                                      // Used to derive the alt of images without alt from the filename
+	UseAriaLabels             bool                                      // Used to fall back to aria-label for empty link text and alt
+	TableMode                 TableMode
+	BaseURL                   string // Used to resolve relative URLs of links and images, defaults to the href of the base element
+	HRMarker                  string // Used for horizontal rules, one of ---, *** or ___
+	StrikethroughMarker       string // Used for del and s, one of ~~ or ~
+	EmphasizeBig              bool   // Used to render big as bold instead of plain text
+	PreserveExistingMarkdown  bool   // Used to pass Markdown already present in text through unescaped
+	NoEscapeListStarts        bool   // Used to keep text like "1." which would start an ordered list unescaped
+	StripLineNumbers          bool   // Used to drop line numbers put in code blocks by syntax highlighters
+	StripPromptMarkers        bool   // Used to drop the prompts such as "$ " of shell sessions in code blocks
+	EditMode                  EditMode
+	MaxBreaks                 int  // Used to limit the consecutive br rendered, defaulting to 1
+	QuoteCiteLinks            bool // Used to render the cite attribute of q as a link after the quote
+	LongQuoteLength           int  // Used to render q and cite longer than this as blockquotes
+	PreferredViewport         int  // Used to choose the source of picture by the width in px of media queries
+	MathMode                  MathMode
+	TaskListMode              TaskListMode
+	Dialect                   Dialect
+	VarMode                   VarMode
+	SampMode                  SampMode
+	BlockquoteCiteAttribution bool              // Used to render the cite at the end of blockquotes as the attribution line "— Author"
+	MergeAdjacentBlockquotes  bool              // Used to merge the blockquotes of the same classes next to each other into one
+	AlertClasses              map[string]string // Used to render elements with the classes as alerts of GitHub, such as {"warning": "WARNING"}
+	KeepStyledElements        bool              // Used to keep elements with class or id as raw HTML, except those which are parts of others such as li
+	TimeMode                  TimeMode
+	BoldRowHeaders            bool                          // Used to render th with scope="row" as bold in tables
+	TrimEmptyTableColumns     bool                          // Used to drop table columns without any content
+	RewriteURL                func(kind, url string) string // Used to rewrite URLs of links and images, dropping them for an empty string
+	MaxHeadingLevel           int                           // Used to render headings deeper than this as bold paragraphs, defaulting to 6
+	NumberHeadings            bool                          // Used to prepend section numbers such as 1.2 to headings
+	PlainText                 bool                          // Used to render the readable text without any Markdown syntax
+	MinimalHeadingEscape      bool                          // Used to escape only the characters which would break headings
+	AbbrMode                  AbbrMode
+	SubSupMode                SubSupMode
+	ImageSizeMode             ImageSizeMode
+	PreserveListIndent        bool // Used to keep the blank lines of code blocks in list items
+	ListMarkerSpacing         int  // Used for the spaces after list markers, from 1 to 4, defaulting to 1
+	BulletChar                rune // Used for the markers of unordered lists, '*', '-' or '+', defaulting to '*'
+	IndentWithTabs            bool // Used to indent the contents of list items with tabs instead of spaces
+	EmbedMode                 EmbedMode
+	OnDrop                    func(reason string, node *html.Node) // Used to report the elements discarded in the conversion
+	MaxLineWidth              int                                  // Used to wrap the lines of paragraphs longer than this
+	Shortcodes                map[string]string                    // Used to render elements by tag name as shortcodes, filling {{.attr}} with attributes
+	doNotEscape               bool                                 // Used to know if to escape certain characters
+	inHeading                 bool                                 // Used to know if permalinks must be stripped
+	inWrap                    bool                                 // Used to know if the lines are wrapped
+	noWrap                    bool                                 // Used to know if the spaces must not be wrapped at
+	inTableCell               bool                                 // Used to know if line breaks must be kept as HTML
+	customRulesMap            map[string]WalkFunc
+	rawScripts                map[*html.Node]string
+	refs                      *references
+	sections                  *sections
 }
 
 // To make a copy of an option without changing the original
@@ -544,23 +3003,270 @@ func (o *Option) Clone() *Option {
 	return &clone
 }
 
+func (o *Option) validate() error {
+	switch o.HRMarker {
+	case "", "---", "***", "___":
+	default:
+		return fmt.Errorf("invalid HRMarker: %q", o.HRMarker)
+	}
+	if o.MaxHeadingLevel < 0 || o.MaxHeadingLevel > 6 {
+		return fmt.Errorf("invalid MaxHeadingLevel: %d", o.MaxHeadingLevel)
+	}
+	switch o.StrikethroughMarker {
+	case "", "~~", "~":
+	default:
+		return fmt.Errorf("invalid StrikethroughMarker: %q", o.StrikethroughMarker)
+	}
+	// Five or more spaces would start a code block in the list item
+	if o.ListMarkerSpacing < 0 || o.ListMarkerSpacing > 4 {
+		return fmt.Errorf("invalid ListMarkerSpacing: %d", o.ListMarkerSpacing)
+	}
+	switch o.BulletChar {
+	case 0, '*', '-', '+':
+	default:
+		return fmt.Errorf("invalid BulletChar: %q", o.BulletChar)
+	}
+	return nil
+}
+
+// Gets the marker of unordered list items, defaulting to "*"
+func (o *Option) bulletChar() string {
+	if o.BulletChar == 0 {
+		return "*"
+	}
+	return string(o.BulletChar)
+}
+
+// Gets the number of spaces after list markers, defaulting to 1
+func (o *Option) listMarkerSpacing() int {
+	if o.ListMarkerSpacing == 0 {
+		return 1
+	}
+	return o.ListMarkerSpacing
+}
+
+// Gets the indentation of the contents of list items, which must be
+// past the marker, such as "10. ", of the item
+func (o *Option) listIndent(marker string) string {
+	if o.IndentWithTabs {
+		return "\t"
+	}
+	n := len(marker)
+	if n < 4 {
+		n = 4
+	}
+	return strings.Repeat(" ", n)
+}
+
+// Sets the defaults of the dialect to the fields left at their zero value
+func (o *Option) applyDialect() {
+	switch o.Dialect {
+	case GitHub:
+		if o.MathMode == MathText {
+			o.MathMode = MathTeX
+		}
+	case Obsidian:
+		if o.MathMode == MathText {
+			o.MathMode = MathTeX
+		}
+		if o.ImageSizeMode == ImageSizeNone {
+			o.ImageSizeMode = ImageSizeObsidian
+		}
+	case CommonMark:
+		if o.TableMode == MarkdownTable {
+			o.TableMode = HTMLTable
+		}
+		if o.EditMode == StrikeEdits {
+			o.EditMode = HTMLEdits
+		}
+		if o.MathMode == MathText {
+			o.MathMode = MathHTML
+		}
+		if o.TaskListMode == TaskListChecks {
+			o.TaskListMode = TaskListHTML
+		}
+	case Pandoc:
+		if o.SubSupMode == SubSupText {
+			o.SubSupMode = SubSupPandoc
+		}
+		if o.MathMode == MathText {
+			o.MathMode = MathTeX
+		}
+		if o.ImageSizeMode == ImageSizeNone {
+			o.ImageSizeMode = ImageSizePandoc
+		}
+	}
+}
+
+// Transcodes the input in the charset to UTF-8. When the charset is empty,
+// it is detected from the BOM or the meta tag, keeping the input as UTF-8
+// if neither tells it.
+func decode(r io.Reader, label string) (io.Reader, error) {
+	if label != "" {
+		return charset.NewReaderLabel(label, r)
+	}
+	br := bufio.NewReaderSize(r, 1024)
+	preview, _ := br.Peek(1024)
+	// Only the BOM is certain, otherwise the input is UTF-8 unless the meta tag tells the charset
+	e, _, certain := charset.DetermineEncoding(preview, "")
+	if !certain {
+		e = nil
+		if label := metaCharset(preview); label != "" {
+			e, _ = charset.Lookup(label)
+		}
+	}
+	if e == nil || e == encoding.Nop {
+		return br, nil
+	}
+	return transform.NewReader(br, e.NewDecoder()), nil
+}
+
+// Gets the charset declared by the meta tag, such as <meta charset="Shift_JIS"> or
+// <meta http-equiv="Content-Type" content="text/html; charset=Shift_JIS">
+func metaCharset(b []byte) string {
+	z := html.NewTokenizer(bytes.NewReader(b))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return ""
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		t := z.Token()
+		if t.Data != "meta" {
+			continue
+		}
+		var httpEquiv, content string
+		for _, a := range t.Attr {
+			switch a.Key {
+			case "charset":
+				return strings.TrimSpace(a.Val)
+			case "http-equiv":
+				httpEquiv = strings.ToLower(strings.TrimSpace(a.Val))
+			case "content":
+				content = a.Val
+			}
+		}
+		if httpEquiv != "content-type" {
+			continue
+		}
+		if i := strings.Index(strings.ToLower(content), "charset="); i >= 0 {
+			label := strings.TrimLeft(content[i+len("charset="):], `"' `)
+			if j := strings.IndexAny(label, `"'; `); j >= 0 {
+				label = label[:j]
+			}
+			return label
+		}
+	}
+}
+
+// Writes the input as is in a fenced code block, ended with a newline
+// unless Option.FinalNewline is NoNewline
+func verbatim(w io.Writer, r io.Reader, option *Option) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	code := strings.TrimRight(string(b), "\r\n")
+	fence := codeFence(code)
+	fmt.Fprint(w, fence+"html\n"+code+"\n"+fence)
+	if option.FinalNewline != NoNewline {
+		fmt.Fprint(w, "\n")
+	}
+	return nil
+}
+
+var bom = []byte("\xef\xbb\xbf")
+
+// Skips the UTF-8 BOM and the whitespace at the start of the input, which
+// would otherwise become the text of the document
+func skipLeading(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	if b, err := br.Peek(len(bom)); err == nil && bytes.Equal(b, bom) {
+		br.Discard(len(bom))
+	}
+	for {
+		b, err := br.Peek(1)
+		if err != nil || !strings.ContainsRune(" \t\r\n\f", rune(b[0])) {
+			return br
+		}
+		br.Discard(1)
+	}
+}
+
 // Convert convert HTML to Markdown. Read HTML from r and write to w.
 func Convert(w io.Writer, r io.Reader, option *Option) error {
+	if option == nil {
+		option = &Option{}
+	}
+	if option.Verbatim {
+		return verbatim(w, r, option)
+	}
+	r, err := decode(r, option.Charset)
+	if err != nil {
+		return err
+	}
+	r = skipLeading(r)
+	var src []byte
+	if option.VerbatimScripts {
+		if src, err = ioutil.ReadAll(r); err != nil {
+			return err
+		}
+		r = bytes.NewReader(src)
+	}
 	doc, err := html.Parse(r)
 	if err != nil {
 		return err
 	}
-	if option == nil {
-		option = &Option{}
+	if err := option.validate(); err != nil {
+		return err
+	}
+	option = option.Clone()
+	option.applyDialect()
+	if option.VerbatimScripts {
+		option.rawScripts = rawScripts(doc, src)
+	}
+	if option.BaseURL == "" {
+		option.BaseURL = baseHref(doc)
 	}
 
+	option.doNotEscape = option.PreserveExistingMarkdown || option.PlainText
+
 	option.customRulesMap = make(map[string]WalkFunc)
 	for _, cr := range option.CustomRules {
 		tag, customWalk := cr.Rule(walk)
 		option.customRulesMap[tag] = customWalk
 	}
 
-	walk(doc, w, 0, option)
-	fmt.Fprint(w, "\n")
+	option.refs = &references{named: option.NamedReferences, sorted: option.SortReferences}
+	option.sections = &sections{}
+
+	root := doc
+	if option.RootSelector != "" {
+		if n := selectRoot(doc, option.RootSelector); n != nil {
+			root = n
+		}
+	}
+
+	var buf bytes.Buffer
+	if !isBlank(doc) {
+		walk(root, &buf, 0, option)
+	}
+	if len(option.refs.defs) > option.refs.written {
+		out := strings.TrimRight(buf.String(), "\n")
+		buf.Reset()
+		buf.WriteString(out + "\n\n")
+		option.refs.write(&buf)
+	}
+	switch option.FinalNewline {
+	case SingleNewline:
+		fmt.Fprint(w, strings.TrimRight(buf.String(), "\n")+"\n")
+	case NoNewline:
+		fmt.Fprint(w, strings.TrimRight(buf.String(), "\n"))
+	default:
+		fmt.Fprint(w, buf.String())
+		fmt.Fprint(w, "\n")
+	}
 	return nil
 }
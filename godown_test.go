@@ -41,6 +41,40 @@ func TestGodown(t *testing.T) {
 	}
 }
 
+// Fixtures in testdata/option need the option of the same name to convert
+var optionFixtures = map[string]*Option{
+	"strip_line_numbers":          {StripLineNumbers: true},
+	"math_tex":                    {MathMode: MathTeX},
+	"trim_empty_table_columns":    {TrimEmptyTableColumns: true},
+	"preserve_list_indent":        {PreserveListIndent: true},
+	"bold_row_headers":            {BoldRowHeaders: true},
+	"merge_blockquotes":           {MergeAdjacentBlockquotes: true},
+	"blockquote_cite_attribution": {BlockquoteCiteAttribution: true},
+}
+
+func TestGodownOption(t *testing.T) {
+	for name, option := range optionFixtures {
+		file := filepath.Join("testdata", "option", name+".html")
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err = Convert(&buf, f, option); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := ioutil.ReadFile(file[:len(file)-4] + "md")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != buf.String() {
+			t.Errorf("(%s):\nwant:\n%s}}}\ngot:\n%s}}}\n", file, string(b), buf.String())
+		}
+		f.Close()
+	}
+}
+
 type errReader int
 
 func (e errReader) Read(p []byte) (n int, err error) {
@@ -210,6 +244,44 @@ alert(1)
 	}
 }
 
+func TestVerbatimScripts(t *testing.T) {
+	script := `<script type='module' data-src=&quot;x&quot; async><!--
+if (a < b && b > c) { s = "&amp; </p>"; }
+--></SCRIPT>`
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader("<p>here is script</p>\n"+script), &Option{
+		Script:          true,
+		VerbatimScripts: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "here is script\n\n" + script + "\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%s}}}\ngot:\n%s}}}\n", want, buf.String())
+	}
+}
+
+func TestVerbatimScriptsContexts(t *testing.T) {
+	// The tokenizer sees the raw text of noscript and svg title as is,
+	// while the parser finds the style in the title of svg
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<noscript><style>.a{}</style></noscript><svg><title><style>.b{}</style></title></svg><p>x</p><script async>var b = 1;</script>`,
+	), &Option{
+		Script:          true,
+		Style:           true,
+		VerbatimScripts: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "\\<style\\>.a{}\\</style\\><style>.b{}</style>\n\nx\n\n\n<script async>var b = 1;</script>\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
 func TestStyle(t *testing.T) {
 	var buf bytes.Buffer
 	err := Convert(&buf, strings.NewReader(`
@@ -325,3 +397,2016 @@ func TestItalicStyle(t *testing.T) {
 		t.Errorf("\nwant:\n%s}}}\ngot:\n%s}}}\n", want, buf.String())
 	}
 }
+
+func TestPreTrailingSpace(t *testing.T) {
+	var buf bytes.Buffer
+	from := "<pre>echo foo\n\n\n  \n</pre>"
+
+	err := Convert(&buf, strings.NewReader(from), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "```\necho foo\n```\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	buf.Reset()
+
+	err = Convert(&buf, strings.NewReader(from), &Option{PreserveCodeTrailingSpace: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "```\necho foo\n\n\n  \n```\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestBlockquoteCode(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader("<blockquote><pre> one\n  two  \n\n\n three\n````</pre></blockquote>"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "> `````\n>  one\n>   two  \n> \n> \n>  three\n> ````\n> `````\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestScriptIndent(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(`<ul><li>foo<script>
+if (a) {
+  alert(1)
+}
+</script></li></ul>`), &Option{
+		Script: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `* foo
+    <script>
+    if (a) {
+      alert(1)
+    }
+    </script>
+
+
+`
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%s}}}\ngot:\n%s}}}\n", want, buf.String())
+	}
+
+	buf.Reset()
+
+	err = Convert(&buf, strings.NewReader(`<blockquote>foo<script>
+if (a) {
+  alert(1)
+}
+</script></blockquote>`), &Option{
+		Script: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `> foo
+> <script>
+> if (a) {
+>   alert(1)
+> }
+> </script>
+
+
+`
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%s}}}\ngot:\n%s}}}\n", want, buf.String())
+	}
+}
+
+func TestHeadingInline(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<h2><del>old<br></del> <mark>new</mark></h2>`,
+	), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "## ~~old~~ new\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestDefaultLang(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(`
+<pre>echo foo</pre>
+<pre><code class="language-python">pass</code></pre>
+	`), &Option{
+		DefaultLang: "bash",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "```bash\necho foo\n```\n\n```python\npass\n```\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+type TestPreRule struct{}
+
+func (r *TestPreRule) Rule(next WalkFunc) (string, WalkFunc) {
+	return "pre", func(node *html.Node, w io.Writer, nest int, option *Option) {
+		fmt.Fprint(w, "~~~\n")
+		next(node, w, nest, option)
+		fmt.Fprint(w, "\n~~~\n")
+	}
+}
+
+func TestWrappedCodeInPre(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<pre><span><code>foo</code></span></pre>`,
+	), &Option{
+		CustomRules: []CustomRule{&TestPreRule{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "~~~\nfoo\n~~~\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestReferenceLink(t *testing.T) {
+	var buf bytes.Buffer
+	from := `<p><a href="https://example.com/foo.png">foo</a> <img src="https://example.com/foo.png" alt="bar"></p>
+<p><a href="https://example.org" title="baz">baz</a></p>`
+
+	err := Convert(&buf, strings.NewReader(from), &Option{LinkStyle: ReferenceLink})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[foo][1] ![bar][1]
+
+[baz][2]
+
+[1]: https://example.com/foo.png
+[2]: https://example.org "baz"
+
+`
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%s}}}\ngot:\n%s}}}\n", want, buf.String())
+	}
+
+	buf.Reset()
+
+	err = Convert(&buf, strings.NewReader(from), &Option{LinkStyle: ReferenceLink, SeparateImageReferences: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `[foo][1] ![bar][img1]
+
+[baz][2]
+
+[1]: https://example.com/foo.png
+[img1]: https://example.com/foo.png
+[2]: https://example.org "baz"
+
+`
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%s}}}\ngot:\n%s}}}\n", want, buf.String())
+	}
+}
+
+func TestImageMap(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(`<img src="map.png" alt="map" usemap="#m">
+<map name="m">
+<area shape="rect" coords="0,0,10,10" href="/a" alt="A">
+<area shape="rect" coords="10,0,20,10" href="/b" alt="B">
+<area shape="rect" coords="20,0,30,10" alt="none">
+</map>`), &Option{
+		ImageMaps: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "![map](map.png)\n\n* [A](/a)\n* [B](/b)\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	from := `<img src="map.png" alt="map" usemap="#m"><map name="m"><area href="/a" alt="[A]"><area href="/b"></map>`
+	for _, tt := range []struct {
+		option *Option
+		want   string
+	}{
+		{&Option{ImageMaps: true, BulletChar: '-', ListMarkerSpacing: 3}, "![map](map.png)\n\n-   [\\[A\\]](/a)\n-   [/b](/b)\n\n\n"},
+		{&Option{ImageMaps: true, PlainText: true}, "map\n\n[A] (/a)\n/b\n\n\n"},
+	} {
+		buf.Reset()
+		err := Convert(&buf, strings.NewReader(from), tt.option)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", tt.want, buf.String())
+		}
+	}
+}
+
+func TestAriaLabels(t *testing.T) {
+	var buf bytes.Buffer
+	from := `<img src="logo.png" alt="" aria-label="Company logo"><a href="/" aria-label="Home"><svg></svg></a>`
+
+	err := Convert(&buf, strings.NewReader(from), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "![](logo.png)\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	buf.Reset()
+
+	err = Convert(&buf, strings.NewReader(from), &Option{UseAriaLabels: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "![Company logo](logo.png)[Home](/)\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestTableModeHTML(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(`<p>foo</p><table><tr><th>a</th></tr><tr><td>b</td></tr></table><p>bar</p>`), &Option{
+		TableMode: HTMLTable,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `foo
+
+
+<table><tbody><tr><th>a</th></tr><tr><td>b</td></tr></tbody></table>
+
+bar
+
+
+`
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%s}}}\ngot:\n%s}}}\n", want, buf.String())
+	}
+}
+
+func TestEmptyDocument(t *testing.T) {
+	for _, from := range []string{"", "  \n\t \n", "<html><body>\n\n</body></html>"} {
+		for _, option := range []*Option{nil, {TrimSpace: true}, {Script: true, Style: true}} {
+			var buf bytes.Buffer
+			err := Convert(&buf, strings.NewReader(from), option)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := "\n"
+			if buf.String() != want {
+				t.Errorf("(%q):\nwant:\n%q}}}\ngot:\n%q}}}\n", from, want, buf.String())
+			}
+		}
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<a href="#usage">usage</a> <a href="../install.html">install</a> <img src="/logo.png" alt="logo">`,
+	), &Option{
+		BaseURL: "https://example.com/docs/guide/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[usage](#usage) [install](https://example.com/docs/install.html) ![logo](https://example.com/logo.png)\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestBaseElement(t *testing.T) {
+	src := `<html><head><base href="https://example.com/docs/guide/"></head>
+<body><a href="../install.html">install</a> <img src="logo.png" alt="logo"></body></html>`
+	for _, tt := range []struct {
+		baseURL string
+		want    string
+	}{
+		{"", "[install](https://example.com/docs/install.html) ![logo](https://example.com/docs/guide/logo.png)\n"},
+		{"https://example.org/", "[install](https://example.org/install.html) ![logo](https://example.org/logo.png)\n"},
+	} {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(src), &Option{BaseURL: tt.baseURL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", tt.want, buf.String())
+		}
+	}
+}
+
+func TestHRMarker(t *testing.T) {
+	for _, marker := range []string{"", "---", "***", "___"} {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(`<hr>`), &Option{HRMarker: marker})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "\n" + marker + "\n\n\n"
+		if marker == "" {
+			want = "\n---\n\n\n"
+		}
+		if buf.String() != want {
+			t.Errorf("(%q):\nwant:\n%q}}}\ngot:\n%q}}}\n", marker, want, buf.String())
+		}
+	}
+
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(`<hr>`), &Option{HRMarker: "==="})
+	if err == nil {
+		t.Fatal("should be an error")
+	}
+}
+
+func TestLegacyElements(t *testing.T) {
+	var buf bytes.Buffer
+	from := `<p>Run <tt>make install</tt> for a <big>big</big> win</p>`
+
+	err := Convert(&buf, strings.NewReader(from), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Run `make install` for a big win\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	buf.Reset()
+
+	err = Convert(&buf, strings.NewReader(from), &Option{EmphasizeBig: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "Run `make install` for a **big** win\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestPreserveExistingMarkdown(t *testing.T) {
+	var buf bytes.Buffer
+	from := `<p>this is **already bold**</p>`
+
+	err := Convert(&buf, strings.NewReader(from), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "this is \\*\\*already bold\\*\\*\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	buf.Reset()
+
+	err = Convert(&buf, strings.NewReader(from), &Option{PreserveExistingMarkdown: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "this is **already bold**\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestObsoleteElements(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<p>foo<spacer type="horizontal" size="10"> <nobr>bar baz</nobr> <blink>blink</blink></p><marquee>scrolling <b>text</b></marquee>`,
+	), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "foo bar baz blink\n\nscrolling **text**\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestEscapeListStarts(t *testing.T) {
+	var buf bytes.Buffer
+	from := `<div>2. reasons</div><div>version 2. is out</div>`
+
+	err := Convert(&buf, strings.NewReader(from), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "2\\. reasons\n\nversion 2. is out\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	buf.Reset()
+
+	err = Convert(&buf, strings.NewReader(from), &Option{NoEscapeListStarts: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "2. reasons\n\nversion 2. is out\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestNestedEmphasis(t *testing.T) {
+	for _, tt := range []struct {
+		from string
+		want string
+	}{
+		{`<b><i>foo</i></b>`, "**_foo_**\n"},
+		{`<b>foo <i>bar</i></b>`, "**foo _bar_**\n"},
+		{`<b><i> foo </i></b>bar`, " **_foo_** bar\n"},
+		{`<i>foo <b>bar</b> baz</i>`, "_foo **bar** baz_\n"},
+		{`<b><del>foo</del></b>`, "**~~foo~~**\n"},
+		{`foo<i>bar</i>baz`, "foo*bar*baz\n"},
+		{`<b>foo<i>bar</i></b>`, "**foo*bar***\n"},
+	} {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(tt.from), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("(%s):\nwant:\n%q}}}\ngot:\n%q}}}\n", tt.from, tt.want, buf.String())
+		}
+	}
+}
+
+func TestEditMode(t *testing.T) {
+	var buf bytes.Buffer
+	from := `<p><del cite="/changes" datetime="2020-01-01">old</del> <ins datetime="2020-01-01">new</ins></p>`
+
+	err := Convert(&buf, strings.NewReader(from), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "~~old~~ new\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	buf.Reset()
+
+	err = Convert(&buf, strings.NewReader(from), &Option{EditMode: HTMLEdits})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `<del cite="/changes" datetime="2020-01-01">old</del> <ins datetime="2020-01-01">new</ins>` + "\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestConsecutiveBreaks(t *testing.T) {
+	var buf bytes.Buffer
+	from := "foo<br><br>\n<br>bar"
+
+	err := Convert(&buf, strings.NewReader(from), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "foo\n\n\nbar\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	buf.Reset()
+
+	err = Convert(&buf, strings.NewReader(from), &Option{MaxBreaks: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "foo\n\n\n\n\n\nbar\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestConditionalComments(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(`<!-- normal comment -->
+<!--[if IE]><p>You are using Internet Explorer.</p><![endif]-->
+<!--[if !IE]><!--><p>You are not using Internet Explorer.</p><!--<![endif]-->`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "<!-- normal comment -->\nYou are not using Internet Explorer.\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestLongQuote(t *testing.T) {
+	var buf bytes.Buffer
+	from := `<p>As <cite>Knuth</cite> said, <q>Premature optimization is the root of all evil.</q></p>`
+
+	err := Convert(&buf, strings.NewReader(from), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "As _Knuth_ said, \"Premature optimization is the root of all evil.\"\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	buf.Reset()
+
+	err = Convert(&buf, strings.NewReader(from), &Option{LongQuoteLength: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "As _Knuth_ said, \n\n> Premature optimization is the root of all evil.\n\n\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestLongQuoteInline(t *testing.T) {
+	tests := []struct {
+		from string
+		want string
+	}{
+		{
+			`<table><tr><th>a</th></tr><tr><td><q>Premature optimization is the root of all evil.</q></td></tr></table>`,
+			"|a                                                |\n|-------------------------------------------------|\n|\"Premature optimization is the root of all evil.\"|\n\n\n",
+		},
+		{
+			`<ul><li>Said <q>Premature optimization is the root of all evil.</q></li></ul>`,
+			"* Said \"Premature optimization is the root of all evil.\"\n\n\n",
+		},
+		{
+			`<dl><dt>Knuth</dt><dd>Said <q>Premature optimization is the root of all evil.</q></dd></dl>`,
+			"Knuth\n: Said \"Premature optimization is the root of all evil.\"\n\n\n",
+		},
+		{
+			`<h2><q>Premature optimization is the root of all evil.</q></h2>`,
+			"## \"Premature optimization is the root of all evil.\"\n\n\n",
+		},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(tt.from), &Option{LongQuoteLength: 20})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", tt.want, buf.String())
+		}
+	}
+}
+
+func TestPictureViewport(t *testing.T) {
+	from := `<picture>
+<source media="(min-width: 1024px)" srcset="large.png 1x, large@2x.png 2x">
+<source media="(min-width: 640px) and (max-width: 1023px)" srcset="medium.png">
+<img src="small.png" alt="photo">
+</picture>`
+	for _, tt := range []struct {
+		viewport int
+		want     string
+	}{
+		{0, "![photo](small.png)"},
+		{1280, "![photo](large.png)"},
+		{800, "![photo](medium.png)"},
+		{320, "![photo](small.png)"},
+	} {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(from), &Option{PreferredViewport: tt.viewport})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(buf.String()); got != tt.want {
+			t.Errorf("(%d):\nwant:\n%q}}}\ngot:\n%q}}}\n", tt.viewport, tt.want, got)
+		}
+	}
+}
+
+func TestCodeSpan(t *testing.T) {
+	for _, tt := range []struct {
+		from string
+		want string
+	}{
+		{"<code>foo</code>", "`foo`\n"},
+		{"<code> code </code>", "`  code  `\n"},
+		{"<code> code</code>", "` code`\n"},
+		{"<code>   </code>", "`   `\n"},
+		{"<code>`a`</code>", "`` `a` ``\n"},
+		{"<code>a``b</code>", "```a``b```\n"},
+		{"<kbd>`</kbd>", "`` ` ``\n"},
+		{"<kbd>a``b</kbd>", "```a``b```\n"},
+		{"<samp>`echo`</samp>", "`` `echo` ``\n"},
+		{"<tt>a`b</tt>", "``a`b``\n"},
+	} {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(tt.from), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("(%s):\nwant:\n%q}}}\ngot:\n%q}}}\n", tt.from, tt.want, buf.String())
+		}
+	}
+}
+
+func TestMathHTML(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(`<p><math><mi>x</mi></math></p>`), &Option{
+		MathMode: MathHTML,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "<math><mi>x</mi></math>\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestTablePipes(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(`<table>
+<tr><th>key</th><th>description</th></tr>
+<tr><td><kbd>Ctrl</kbd>+<samp>|</samp></td><td><code>a|b</code> or c|d</td></tr>
+</table>`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "|key         |description   |\n" +
+		"|------------|--------------|\n" +
+		"|`Ctrl`\\+`\\|`|`a\\|b` or c\\|d|\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%s}}}\ngot:\n%s}}}\n", want, buf.String())
+	}
+}
+
+func TestDialect(t *testing.T) {
+	from := `<ul><li><input type="checkbox" checked> done</li><li><input type="checkbox"> todo</li></ul>
+<table><tr><th>a</th></tr><tr><td>b</td></tr></table>`
+
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(from), &Option{Dialect: GitHub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "* [x] done\n* [ ] todo\n\n|a|\n|-|\n|b|\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	buf.Reset()
+
+	err = Convert(&buf, strings.NewReader(from), &Option{Dialect: CommonMark})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "* <input type=\"checkbox\" checked=\"\"/> done\n* <input type=\"checkbox\"/> todo\n\n<table><tbody><tr><th>a</th></tr><tr><td>b</td></tr></tbody></table>\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	buf.Reset()
+
+	// Explicit fields override the preset
+	err = Convert(&buf, strings.NewReader(from), &Option{Dialect: GitHub, TaskListMode: TaskListHTML})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "* <input type=\"checkbox\" checked=\"\"/> done\n* <input type=\"checkbox\"/> todo\n\n|a|\n|-|\n|b|\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestDialectImageSize(t *testing.T) {
+	from := `<p><img src="a.png" alt="A" width="100" height="50px"> <img src="b.png" alt="B" width="50%"></p>`
+
+	tests := []struct {
+		option *Option
+		want   string
+	}{
+		{nil, "![A](a.png) ![B](b.png)\n\n\n"},
+		{&Option{Dialect: Pandoc}, "![A](a.png){width=100 height=50} ![B](b.png)\n\n\n"},
+		{&Option{Dialect: Obsidian}, "![A|100x50](a.png) ![B](b.png)\n\n\n"},
+		{&Option{Dialect: Obsidian, ImageSizeMode: ImageSizePandoc}, "![A](a.png){width=100 height=50} ![B](b.png)\n\n\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(from), tt.option)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", tt.want, buf.String())
+		}
+	}
+}
+
+func TestVarSampMode(t *testing.T) {
+	from := `<p>Set <var>n</var> and see <samp>ok</samp></p>`
+
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(from), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Set _n_ and see `ok`\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	buf.Reset()
+
+	err = Convert(&buf, strings.NewReader(from), &Option{VarMode: VarCode, SampMode: SampPlain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "Set `n` and see ok\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestBlockInInline(t *testing.T) {
+	for _, tt := range []struct {
+		from string
+		want string
+	}{
+		{`<b>foo<p>bar</p>baz</b>`, "**foo**\n**bar**\n\n\n**baz**\n"},
+		{`<a href="/x">foo<div>bar</div></a>`, "[foo](/x)\n[bar](/x)\n\n"},
+		{`<b><ul><li>x</li><li>y</li></ul></b>`, "* **x**\n* **y**\n\n\n"},
+		{`<b><blockquote><h2>x</h2></blockquote><hr><pre>y</pre></b>`, "> ## **x**\n\n\n\n---\n\n```\ny\n```\n\n\n"},
+	} {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(tt.from), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("(%s):\nwant:\n%q}}}\ngot:\n%q}}}\n", tt.from, tt.want, buf.String())
+		}
+	}
+}
+
+func TestKeepStyledElements(t *testing.T) {
+	from := `<div class="callout"><p>Note <span id="x">this</span></p></div>`
+
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(from), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Note this\n\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	buf.Reset()
+
+	err = Convert(&buf, strings.NewReader(from), &Option{KeepStyledElements: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "<div class=\"callout\">\n\nNote <span id=\"x\">this</span>\n\n\n\n</div>\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	// Not only wrappers, but blocks and inline elements are kept, except
+	// links and headings, and the URLs of those kept are resolved
+	buf.Reset()
+	err = Convert(&buf, strings.NewReader(`<p class="lead">Read <a class="more" href="/more">more</a></p><ul class="list"><li>one</li></ul><h2 id="intro">Intro</h2><blockquote class="q" cite="/src">Quote</blockquote>`), &Option{
+		KeepStyledElements: true,
+		BaseURL:            "https://example.com/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "<p class=\"lead\">\n\nRead [more](https://example.com/more)\n\n</p>\n\n\n* one\n\n\n## Intro\n\n\n<blockquote class=\"q\" cite=\"https://example.com/src\">\n\nQuote\n\n</blockquote>\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestTimeInTable(t *testing.T) {
+	from := `<table><tr><th>release</th></tr><tr><td><time datetime="2020-01-02
+	10:00">Jan 2</time></td></tr></table>`
+	for _, tt := range []struct {
+		mode TimeMode
+		want string
+	}{
+		{TimeText, "|release|\n|-------|\n|Jan 2  |\n\n\n"},
+		{TimeDatetime, "|release           |\n|------------------|\n|2020\\-01\\-02 10:00|\n\n\n"},
+		{TimeAppend, "|release                     |\n|----------------------------|\n|Jan 2 \\(2020\\-01\\-02 10:00\\)|\n\n\n"},
+	} {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(from), &Option{TimeMode: tt.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("(%d):\nwant:\n%s}}}\ngot:\n%s}}}\n", tt.mode, tt.want, buf.String())
+		}
+	}
+}
+
+func TestListStart(t *testing.T) {
+	for _, tt := range []struct {
+		from string
+		want string
+	}{
+		{`<ol start="5"><li>foo</li><li>bar</li></ol>`, "5. foo\n6. bar\n\n\n"},
+		{`<ol start="five"><li>foo</li><li>bar</li></ol>`, "1. foo\n2. bar\n\n\n"},
+		{`<ol start="-2"><li>foo</li></ol>`, "1. foo\n\n\n"},
+	} {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(tt.from), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("(%s):\nwant:\n%q}}}\ngot:\n%q}}}\n", tt.from, tt.want, buf.String())
+		}
+	}
+}
+
+func TestReversedList(t *testing.T) {
+	for _, tt := range []struct {
+		from string
+		want string
+	}{
+		{`<ol reversed><li>foo</li><li>bar</li><li>baz</li></ol>`, "3. foo\n2. bar\n1. baz\n\n\n"},
+		{`<ol reversed start="10"><li>foo</li><li>bar</li><li>baz</li></ol>`, "10. foo\n9. bar\n8. baz\n\n\n"},
+		{`<ol reversed start="1"><li>foo</li><li>bar</li><li>baz</li></ol>`, "1. foo\n0. bar\n0. baz\n\n\n"},
+	} {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(tt.from), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("(%s):\nwant:\n%q}}}\ngot:\n%q}}}\n", tt.from, tt.want, buf.String())
+		}
+	}
+}
+
+func TestRewriteURL(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<a href="/about">about</a> <img src="/img/logo.png" alt="logo"> <img src="/tracker.gif"> <a href="/ads">ads</a>`,
+	), &Option{
+		BaseURL: "https://old.example.com/",
+		RewriteURL: func(kind, url string) string {
+			if strings.HasSuffix(url, ".gif") || strings.HasSuffix(url, "/ads") {
+				return ""
+			}
+			if kind == "image" {
+				return strings.Replace(url, "old.example.com", "cdn.example.com", 1)
+			}
+			return url
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[about](https://old.example.com/about) ![logo](https://cdn.example.com/img/logo.png)  ads\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestMultiLineSamp(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<p>The output is:<samp>total 0<br>-rw-r--r-- 1 user user 0 foo</samp></p>`,
+	), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "The output is:\n```\ntotal 0\n-rw-r--r-- 1 user user 0 foo\n```\n\n\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestNumberHeadings(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<h1>Intro</h1><h2>Background</h2><h2>Goals</h2><h1>Usage</h1><h2>Install</h2>`,
+	), &Option{
+		NumberHeadings: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# 1 Intro\n\n\n## 1.1 Background\n\n\n## 1.2 Goals\n\n\n# 2 Usage\n\n\n## 2.1 Install\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestBreakInTableCell(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<table><tr><th>address</th></tr><tr><td>1 Main St<br>Springfield</td></tr></table>`,
+	), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "|address                 |\n|------------------------|\n|1 Main St<br>Springfield|\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestPlainText(t *testing.T) {
+	input := `<h1>Getting *started*</h1>
+<p>Read the <a href="https://example.com/docs">docs</a> or <b>mail</b> <a href="mailto:me@example.com">me@example.com</a>.</p>
+<ul><li>Use <code>go get</code></li><li><img src="logo.png" alt="Logo"></li></ul>
+<blockquote>Keep it <em>simple</em></blockquote>
+<hr>
+<table><tr><th>name</th><th>note</th></tr><tr><td>a|b</td><td>one<br>two</td></tr></table>
+<dl><dt>Term</dt><dd>Definition</dd></dl>
+<ul><li><input type="checkbox" checked> done</li></ul>`
+
+	tests := []struct {
+		option *Option
+		want   string
+	}{
+		{
+			option: nil,
+			want:   "# Getting \\*started\\*\n\nRead the [docs](https://example.com/docs) or **mail** [me@example.com](mailto:me@example.com).\n\n* Use `go get`\n* ![Logo](logo.png)\n\n> Keep it _simple_\n\n\n---\n\n|name|note      |\n|----|----------|\n|a\\|b|one<br>two|\n\nTerm\n: Definition\n\n* [x] done\n\n\n",
+		},
+		{
+			option: &Option{PlainText: true},
+			want:   "Getting *started*\n\nRead the docs (https://example.com/docs) or mail me@example.com.\n\nUse go get\nLogo\n\n    Keep it simple\n\n\n\nname\tnote\na|b\tone two\n\nTerm\n    Definition\n\ndone\n\n\n",
+		},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := Convert(&buf, strings.NewReader(input), test.option); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.want {
+			t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", test.want, buf.String())
+		}
+	}
+}
+
+func TestMinimalHeadingEscape(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<h2>snake_case, 2 * 3, _x_ and *y* in C#</h2><h2>Issue #</h2>`,
+	), &Option{
+		MinimalHeadingEscape: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "## snake_case, 2 * 3, \\_x\\_ and \\*y\\* in C#\n\n\n## Issue \\#\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestLangFromNode(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<div class="code-label">python</div><pre>print("hi")</pre>`,
+	), &Option{
+		LangFromNode: func(pre *html.Node) string {
+			for n := pre.PrevSibling; n != nil; n = n.PrevSibling {
+				if n.Type == html.ElementNode && hasClass(n, "code-label") {
+					return strings.TrimSpace(n.FirstChild.Data)
+				}
+			}
+			return ""
+		},
+		GuessLang: func(s string) (string, error) { return "text", nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "python\n\n```python\nprint(\"hi\")\n```\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestShortcodes(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<p>A cat:</p><figure><img src="tama.png" alt="Tama"><figcaption>Tama in the sun</figcaption></figure>`,
+	), &Option{
+		Shortcodes: map[string]string{
+			"figure": `{{< figure src="{{.src}}" alt="{{ .alt }}" caption="{{.text}}" >}}`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "A cat:\n\n\n{{< figure src=\"tama.png\" alt=\"Tama\" caption=\"Tama in the sun\" >}}\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestEmbedMode(t *testing.T) {
+	input := `<p>Manual: <object data="file.pdf" type="application/pdf"><noembed>Download the <b>PDF</b></noembed></object></p>`
+
+	tests := []struct {
+		mode EmbedMode
+		want string
+	}{
+		{EmbedFallback, "Manual: Download the **PDF**\n\n\n"},
+		{EmbedLink, "Manual: [file.pdf](file.pdf)\n\n\n"},
+		{EmbedHTML, "Manual: <object data=\"file.pdf\" type=\"application/pdf\"><noembed>Download the <b>PDF</b></noembed></object>\n\n\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(input), &Option{
+			EmbedMode: test.mode,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.want {
+			t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", test.want, buf.String())
+		}
+	}
+}
+
+func TestNamedSortedReferences(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<p><a href="https://golang.org">Go</a> and <a href="https://example.com/faq">the FAQ</a> or <a href="https://example.com/Go">Go</a>, <a href="https://golang.org">Go</a></p>`,
+	), &Option{
+		LinkStyle:       ReferenceLink,
+		NamedReferences: true,
+		SortReferences:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[Go][go] and [the FAQ][the-faq] or [Go][go-2], [Go][go]
+
+[go-2]: https://example.com/Go
+[the-faq]: https://example.com/faq
+[go]: https://golang.org
+
+`
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%s}}}\ngot:\n%s}}}\n", want, buf.String())
+	}
+}
+
+func TestMaxLineWidthNoWrap(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<p>Call us at <span style="white-space: nowrap">+1 555 0100 2000</span> any time of the day.</p>`,
+	), &Option{
+		MaxLineWidth: 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Call us at\n\\+1 555 0100 2000\nany time of the day.\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestAdjacentCodeSpans(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<p>Press <kbd>Ctrl</kbd><kbd>C</kbd> or run <code>a</code> <code>b</code></p>`,
+	), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Press `Ctrl`<!-- -->`C` or run `a` `b`\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestOnDrop(t *testing.T) {
+	var reasons []string
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<p>Logo: <img src="" alt="logo"><script>alert(1)</script></p>`,
+	), &Option{
+		OnDrop: func(reason string, node *html.Node) {
+			reasons = append(reasons, reason+": "+node.Data)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"image without src: img", "script: script"}
+	if fmt.Sprint(reasons) != fmt.Sprint(want) {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, reasons)
+	}
+}
+
+func TestListInList(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<ol><li>One</li><ol><li>Sub a</li><li>Sub b</li></ol><li>Two</li></ol><ul><ul><li>Orphan</li></ul><li>Item</li></ul>`,
+	), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "1. One\n    1. Sub a\n    2. Sub b\n2. Two\n\n\n* Orphan\n* Item\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestRuleInBlockquote(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<blockquote><p>Before</p><hr><p>After</p></blockquote>`,
+	), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "> Before\n> \n> ---\n> \n> After\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestAbbrInLink(t *testing.T) {
+	from := `<p>See the <a href="https://example.com/(spec)"><abbr title="HyperText [Markup] Language">HTML</abbr> spec</a>.</p>`
+	for _, tt := range []struct {
+		option *Option
+		want   string
+	}{
+		{&Option{}, "See the [HTML spec](https://example.com/(spec)).\n\n\n"},
+		{&Option{AbbrMode: AbbrExpand}, "See the [HTML \\(HyperText \\[Markup\\] Language\\) spec](https://example.com/(spec)).\n\n\n"},
+		{&Option{AbbrMode: AbbrExpand, PreserveExistingMarkdown: true}, "See the [HTML (HyperText \\[Markup\\] Language) spec](https://example.com/(spec)).\n\n\n"},
+	} {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(from), tt.option)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", tt.want, buf.String())
+		}
+	}
+}
+
+func TestLeadingBOM(t *testing.T) {
+	for _, from := range []string{
+		"\xef\xbb\xbf<html><body><p>Hello</p></body></html>",
+		"\xef\xbb\xbf\r\n  <p>Hello</p>",
+		"\n\n  Hello",
+	} {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(from), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(buf.String(), "Hello\n") {
+			t.Errorf("(%q):\nwant prefix:\n%q}}}\ngot:\n%q}}}\n", from, "Hello\n", buf.String())
+		}
+	}
+}
+
+func TestCharset(t *testing.T) {
+	// "日本語" in Shift_JIS, without any meta tag to detect it from
+	from := "<p>\x93\xfa\x96\x7b\x8c\xea</p>"
+
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(from), &Option{Charset: "Shift_JIS"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "日本語\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	err = Convert(&buf, strings.NewReader(from), &Option{Charset: "unknown"})
+	if err == nil {
+		t.Fatal("should be an error")
+	}
+
+	// The word "charset" in the text is not a declaration of the charset
+	buf.Reset()
+	err = Convert(&buf, strings.NewReader("<p>Set the charset of the page.</p>"+strings.Repeat(" ", 1024)+"<p>ü é</p>"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "Set the charset of the page.\n\n ü é\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	buf.Reset()
+	err = Convert(&buf, strings.NewReader(`<meta http-equiv="Content-Type" content="text/html; charset=Shift_JIS">`+from), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "日本語\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestBlockDel(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<del><p>First</p><p>Second</p></del><p>Keep <del>this</del></p>`,
+	), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "<del>\n\nFirst\n\n\nSecond\n\n\n\n\n</del>\n\nKeep ~~this~~\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestListMarkerSpacing(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<ul><li>One<ol><li>Sub</li><li>Sub two<p>More</p></li></ol></li><li>Two</li></ul>`,
+	), &Option{
+		ListMarkerSpacing: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "*   One\n    1.   Sub\n    2.   Sub two\n         More\n*   Two\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	buf.Reset()
+
+	// The contents are indented past the marker of each item
+	err = Convert(&buf, strings.NewReader(
+		`<ol start="9"><li>Nine</li><li>Ten<p>More</p></li></ol>`,
+	), &Option{
+		ListMarkerSpacing: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "9.    Nine\n10.    Ten\n       More\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	err = Convert(&buf, strings.NewReader(`<ul><li>One</li></ul>`), &Option{ListMarkerSpacing: 5})
+	if err == nil {
+		t.Fatal("should be an error")
+	}
+}
+
+func TestNestedPre(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader("<pre><samp>$ cat README.md</samp>\n<pre>```\n<b>go</b> build\n```</pre><output>ok</output></pre>"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "````\n$ cat README.md\n```\ngo build\n```ok\n````\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestBulletChar(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<ul><li>One<ul><li>Sub</li></ul></li><li>Two</li></ul>`,
+	), &Option{
+		BulletChar: '-',
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "- One\n    - Sub\n- Two\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	err = Convert(&buf, strings.NewReader(`<ul><li>One</li></ul>`), &Option{BulletChar: '#'})
+	if err == nil {
+		t.Fatal("should be an error")
+	}
+}
+
+func TestOrphanSummary(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<div><summary>Overview</summary>Text</div>`,
+	), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "**Overview**\n\nText\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestIndentWithTabs(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<ul><li>One<ul><li>Sub<ol><li>Deep</li></ol></li></ul></li><li>Two<pre>  code</pre></li></ul>`,
+	), &Option{
+		IndentWithTabs: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "* One\n\t* Sub\n\t\t1. Deep\n* Two\n\t```\n\t  code\n\t```\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestSpacesInCodeSpan(t *testing.T) {
+	for _, tt := range []struct {
+		from string
+		want string
+	}{
+		{"<p><code>a    b</code></p>", "`a    b`\n\n\n"},
+		{"<ul><li><kbd>Ctrl  C</kbd></li></ul>", "* `Ctrl  C`\n\n\n"},
+		{"<h2>Use <code>a   b</code></h2>", "## Use `a   b`\n\n\n"},
+	} {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(tt.from), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("(%s):\nwant:\n%q}}}\ngot:\n%q}}}\n", tt.from, tt.want, buf.String())
+		}
+	}
+}
+
+func TestVerbatim(t *testing.T) {
+	from := "<p>Hello, <b>world</b></p>\n<pre>```go\nfmt.Println()\n```</pre>\n"
+
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(from), &Option{Verbatim: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "````html\n" + strings.TrimRight(from, "\n") + "\n````\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	buf.Reset()
+
+	err = Convert(&buf, strings.NewReader(from), &Option{Verbatim: true, FinalNewline: NoNewline})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "````html\n" + strings.TrimRight(from, "\n") + "\n````"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	var e errReader
+	if err := Convert(&buf, e, &Option{Verbatim: true}); err == nil {
+		t.Fatal("should be an error")
+	}
+}
+
+func TestTaskListLabel(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<ul><li><label><input type="checkbox" checked> Done</label></li><li> <span><label><input type="checkbox">Todo</label></span></li></ul>`,
+	), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "* [x] Done\n* [ ] Todo\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestTaskListParagraph(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<ol><li><p><input type="checkbox" checked> Boil water</p><p>Use soft water.</p></li><li><p><input type="checkbox">Brew</p></li></ol>`,
+	), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "1. [x] Boil water\n    Use soft water.\n2. [ ] Brew\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	// The state is rendered by default, and kept as raw HTML for Markdown without task lists
+	buf.Reset()
+	err = Convert(&buf, strings.NewReader(`<ul><li><input type="checkbox" checked> done</li><li><input type="checkbox"> todo</li></ul>`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "* [x] done\n* [ ] todo\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	buf.Reset()
+	err = Convert(&buf, strings.NewReader(`<ul><li><input type="checkbox" checked> Done</li></ul>`), &Option{TaskListMode: TaskListHTML})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "* <input type=\"checkbox\" checked=\"\"/> Done\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestStrikethroughMarker(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<p><del>old</del> and <s>wrong</s></p>`,
+	), &Option{
+		StrikethroughMarker: "~",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "~old~ and ~wrong~\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	err = Convert(&buf, strings.NewReader(`<s>x</s>`), &Option{StrikethroughMarker: "--"})
+	if err == nil {
+		t.Fatal("should be an error")
+	}
+}
+
+func TestTableCaption(t *testing.T) {
+	from := `<table><caption>Prices <b>2020</b></caption><tr><th>item</th></tr><tr><td>tea</td></tr></table>`
+	for _, tt := range []struct {
+		dialect Dialect
+		want    string
+	}{
+		{NoDialect, "Prices **2020**\n\n|item|\n|----|\n|tea |\n\n\n"},
+		{Pandoc, "|item|\n|----|\n|tea |\n\n: Prices **2020**\n\n\n"},
+	} {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(from), &Option{Dialect: tt.dialect})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", tt.want, buf.String())
+		}
+	}
+}
+
+func TestTableCellBreaks(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(`<table>
+<tr><th>note</th></tr>
+<tr><td>green<br> <br> tea</td></tr>
+<tr><td><p>black</p><br><p>tea</p></td></tr>
+</table>`), &Option{MaxBreaks: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "|note        |\n|------------|\n|green<br>tea|\n|black<br>tea|\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestTrimAllEmptyTableColumns(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<p>before</p><table><tr><th></th><th> </th></tr><tr><td></td><td></td></tr></table><p>after</p>`,
+	), &Option{
+		TrimEmptyTableColumns: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "before\n\n\n\nafter\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestTableAlign(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(`<table>
+<tr><th align="left">name</th><th style="text-align: center">id</th><th>price</th><th>note</th></tr>
+<tr><td>tea</td><td>1</td><td align="right">100</td><td align="justify">hot</td></tr>
+</table>`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "|name|id |price|note|\n|:---|:-:|----:|----|\n|tea |1  |100  |hot |\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestTableColspan(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(`<table>
+<tr><th colspan="2">name</th><th>price</th></tr>
+<tr><td>green</td><td>tea</td><td>100</td></tr>
+<tr><td colspan="x">black</td><td>tea</td><td>120</td></tr>
+</table>`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "|name |   |price|\n|-----|---|-----|\n|green|tea|100  |\n|black|tea|120  |\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestVideoPoster(t *testing.T) {
+	from := `<p><video poster="thumb.jpg" src="tea.mp4" controls>Your browser does not support video.</video></p>`
+	for _, tt := range []struct {
+		mode EmbedMode
+		want string
+	}{
+		{EmbedFallback, "[![video](https://example.com/thumb.jpg)](https://example.com/tea.mp4)\n\n\n"},
+		{EmbedHTML, "<video poster=\"thumb.jpg\" src=\"tea.mp4\" controls=\"\">Your browser does not support video.</video>\n\n\n"},
+	} {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(from), &Option{EmbedMode: tt.mode, BaseURL: "https://example.com/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", tt.want, buf.String())
+		}
+	}
+}
+
+func TestEscapeImageSyntax(t *testing.T) {
+	from := `<p>click the ![button] or !<a href="/a">link</a></p><h2>click the ![button] or !<a href="/a">link</a></h2><h1>Hello!</h1><h1>Wow!<b><a href="/b">bold</a></b></h1>`
+	for _, tt := range []struct {
+		option *Option
+		want   string
+	}{
+		{&Option{}, "click the \\!\\[button\\] or \\![link](/a)\n\n\n## click the \\!\\[button\\] or \\![link](/a)\n\n\n# Hello\\!\n\n\n# Wow\\!**[bold](/b)**\n\n\n"},
+		{&Option{MinimalHeadingEscape: true}, "click the \\!\\[button\\] or \\![link](/a)\n\n\n## click the !\\[button\\] or \\![link](/a)\n\n\n# Hello!\n\n\n# Wow\\!**[bold](/b)**\n\n\n"},
+	} {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(from), tt.option)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", tt.want, buf.String())
+		}
+	}
+}
+
+func TestHeadingStyle(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<h1>Guide of <em>tea</em></h1><h2>お茶</h2><h3>Setup</h3>`,
+	), &Option{
+		HeadingStyle: SetextHeading,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Guide of _tea_\n==============\n\n\nお茶\n----\n\n\n### Setup\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestMaxHeadingLevel(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<h1>Guide</h1><h3>Setup</h3><h4>On <i>Linux</i></h4><p>Run it.</p>`,
+	), &Option{
+		MaxHeadingLevel: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# Guide\n\n\n### Setup\n\n\n**On _Linux_**\n\n\nRun it.\n\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestRootSelector(t *testing.T) {
+	from := `<html><body>
+<nav><a href="/">Home</a></nav>
+<main><h1>Title</h1><p>Content</p></main>
+<footer>Copyright</footer>
+</body></html>`
+
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(from), &Option{RootSelector: "article, main"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# Title\n\n\nContent\n\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	// The whole document is converted when nothing matches
+	buf.Reset()
+	if err := Convert(&buf, strings.NewReader(from), nil); err != nil {
+		t.Fatal(err)
+	}
+	want = buf.String()
+	buf.Reset()
+	if err := Convert(&buf, strings.NewReader(from), &Option{RootSelector: "article, #missing"}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestAlertClasses(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<p>Intro</p><div class="admonition warning"><p>Back up <b>first</b>.</p><p>Really.</p></div>`,
+	), &Option{
+		AlertClasses: map[string]string{"warning": "WARNING", "note": "NOTE"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Intro\n\n\n> [!WARNING]\n> Back up **first**.\n> \n> Really.\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestStripPromptMarkers(t *testing.T) {
+	for _, tt := range []struct {
+		from string
+		want string
+	}{
+		{
+			`<pre><code class="language-console"><span class="gp">$ </span>echo "hello \
+&gt; world"
+hello world</code></pre>`,
+			"```console\necho \"hello \\\nworld\"\nhello world\n```\n\n\n",
+		},
+		{
+			"<pre>$ go version\ngo version go1.14 linux/amd64</pre>",
+			"```\ngo version\ngo version go1.14 linux/amd64\n```\n\n\n",
+		},
+		{
+			"<pre><code class=\"language-go\">x := $ y\n$ z</code></pre>",
+			"```go\nx := $ y\n$ z\n```\n\n\n",
+		},
+	} {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(tt.from), &Option{StripPromptMarkers: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("(%s):\nwant:\n%q}}}\ngot:\n%q}}}\n", tt.from, tt.want, buf.String())
+		}
+	}
+}
+
+func TestThumbnailLink(t *testing.T) {
+	for _, tt := range []struct {
+		from string
+		want string
+	}{
+		{
+			`<a href="full.jpg" title="Full size"><img src="thumb.jpg" alt="Cat" title="A cat"></a>`,
+			"[![Cat](thumb.jpg \"A cat\")](full.jpg \"Full size\")\n",
+		},
+		{
+			`<a href="full.jpg" title="Full size"><img src="thumb.jpg"></a>`,
+			"[![Full size](thumb.jpg)](full.jpg \"Full size\")\n",
+		},
+		{
+			`<a href="full.jpg"> <img src="thumb.jpg" title="Thumb"> </a>`,
+			"[![Thumb](thumb.jpg \"Thumb\")](full.jpg)\n",
+		},
+		{
+			`<a href="full.jpg" title="Full size">See <img src="thumb.jpg"></a>`,
+			"[See ![](thumb.jpg)](full.jpg \"Full size\")\n",
+		},
+	} {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(tt.from), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("(%s):\nwant:\n%q}}}\ngot:\n%q}}}\n", tt.from, tt.want, buf.String())
+		}
+	}
+}
+
+func TestLinkTextWhitespace(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(`<p>See <a href="/guide">
+    the brewing
+    guide
+</a> first.</p>
+<p><a href="/tea">
+  <b>Green</b><br>
+  tea
+</a></p>
+<p>Or<a href="/coffee">
+coffee</a>.</p>`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "See [the brewing guide](/guide) first.\n\n[**Green** tea](/tea)\n\nOr [coffee](/coffee).\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestDropAriaHidden(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<p><a href="/settings"><span class="icon" aria-hidden="true">⚙</span> Settings</a><span aria-hidden="false"> now</span></p>`,
+	), &Option{
+		DropAriaHidden: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[Settings](/settings) now\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestReferencesPerSection(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<h1>One</h1><p>See <a href="https://a.example">A</a>.</p><h2>Two</h2><p>See <a href="https://b.example">B</a> and <a href="https://a.example">A</a>.</p>`,
+	), &Option{
+		LinkStyle:            ReferenceLink,
+		ReferencesPerSection: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# One\n\n\nSee [A][1].\n\n\n[1]: https://a.example\n\n\n## Two\n\n\nSee [B][2] and [A][1].\n\n[2]: https://b.example\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	// The headings in list items and table cells do not start sections
+	buf.Reset()
+	err = Convert(&buf, strings.NewReader(
+		`<p><a href="http://a">a</a></p><table><tr><th>x</th></tr><tr><td><h2>S</h2>y</td></tr></table><ul><li><h2>T</h2></li></ul>`,
+	), &Option{
+		LinkStyle:            ReferenceLink,
+		ReferencesPerSection: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "[a][1]\n\n\n|x        |\n|---------|\n|## S<br>y|\n\n* ## T\n\n[1]: http://a\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestSelectOptgroup(t *testing.T) {
+	from := `<p>Food: <select name="food"><option>Any</option><optgroup label="Fruits"><option>Apple</option><option label="Banana">b</option></optgroup><optgroup label="Vegetables"><option>Kale</option></optgroup></select></p>`
+	for _, tt := range []struct {
+		forms bool
+		want  string
+	}{
+		{false, "Food: AnyApplebKale\n\n\n"},
+		{true, "Food: \n* Any\n* **Fruits**\n    * Apple\n    * Banana\n* **Vegetables**\n    * Kale\n\n\n\n\n"},
+	} {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(from), &Option{Forms: tt.forms})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", tt.want, buf.String())
+		}
+	}
+}
+
+func TestDatalist(t *testing.T) {
+	from := `<p><label for="tea">Tea</label> <input id="tea" list="teas"></p><datalist id="teas"><option value="Green"><option value="Black"><option>Oolong</option></datalist>`
+	for _, tt := range []struct {
+		forms bool
+		want  string
+	}{
+		{false, "Tea \n\n\n"},
+		{true, "Tea \n\n\nTea\n\n* Green\n* Black\n* Oolong\n\n\n"},
+	} {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(from), &Option{Forms: tt.forms})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", tt.want, buf.String())
+		}
+	}
+}
+
+func TestDelInTableCell(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<table><tr><th>plan</th></tr><tr><td><del>A | B</del></td></tr><tr><td><del><p>First</p><p>Second</p></del></td></tr></table>`,
+	), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "|plan                   |\n|-----------------------|\n|~~A \\| B~~             |\n|~~First~~<br>~~Second~~|\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestFinalNewline(t *testing.T) {
+	from := `<p>Hello</p>`
+	for _, tt := range []struct {
+		mode FinalNewline
+		want string
+	}{
+		{DoubleNewline, "Hello\n\n\n"},
+		{SingleNewline, "Hello\n"},
+		{NoNewline, "Hello"},
+	} {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(from), &Option{FinalNewline: tt.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", tt.want, buf.String())
+		}
+	}
+}
+
+func TestImageAltFallback(t *testing.T) {
+	for _, tt := range []struct {
+		from string
+		want string
+	}{
+		{`<img src="https://example.com/img/sunset_beach-2.jpg?w=100">`, "![sunset beach 2](https://example.com/img/sunset_beach-2.jpg?w=100)\n"},
+		{`<img src="/img/spacer.gif" alt="">`, "![](/img/spacer.gif)\n"},
+		{`<img src="logo.png" alt="Logo">`, "![Logo](logo.png)\n"},
+	} {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(tt.from), &Option{ImageAltFallback: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("(%s):\nwant:\n%q}}}\ngot:\n%q}}}\n", tt.from, tt.want, buf.String())
+		}
+	}
+}
+
+func TestQuoteCiteLinks(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<p>He said <q cite="https://example.com/speech">Go is fun</q> and <q>that's all</q>.</p>`,
+	), &Option{
+		QuoteCiteLinks: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "He said \"Go is fun\" ([source](https://example.com/speech)) and \"that's all\".\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	buf.Reset()
+
+	err = Convert(&buf, strings.NewReader(
+		`<p><a href="/talk">He said <q cite="https://example.com/speech">Go is fun</q></a></p>`,
+	), &Option{
+		QuoteCiteLinks: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "[He said \"Go is fun\"](/talk)\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestBreakOpportunityInPre(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		"<pre>veryLong<wbr>Name := \"soft\u00adhyphen\"<wbr></pre>",
+	), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "```\nveryLongName := \"soft\u00adhyphen\"\n```\n\n\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestEmbedImages(t *testing.T) {
+	var buf bytes.Buffer
+	err := Convert(&buf, strings.NewReader(
+		`<img src="img/dot.png" alt="dot"> <img src="img/missing.png" alt="missing"> <img src="https://example.com/remote.png" alt="remote">`,
+	), &Option{
+		EmbedImages: true,
+		FileResolver: func(path string) ([]byte, string, error) {
+			if path == "img/dot.png" {
+				return []byte("PNG"), "image/png", nil
+			}
+			return nil, "", os.ErrNotExist
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "![dot](data:image/png;base64,UE5H) ![missing](img/missing.png) ![remote](https://example.com/remote.png)\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+
+	// The alt from the file name is of the path, not of the data URI
+	buf.Reset()
+	err = Convert(&buf, strings.NewReader(`<img src="img/sunset_beach.png">`), &Option{
+		EmbedImages:      true,
+		ImageAltFallback: true,
+		FileResolver: func(path string) ([]byte, string, error) {
+			return []byte("PNG"), "image/png", nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "![sunset beach](data:image/png;base64,UE5H)\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", want, buf.String())
+	}
+}
+
+func TestSubSup(t *testing.T) {
+	from := `<p>H<sub>2</sub>O and x<sup>2</sup> + y<sup>n + 1</sup></p>`
+	for _, tt := range []struct {
+		mode SubSupMode
+		want string
+	}{
+		{SubSupText, "H2O and x2 \\+ yn \\+ 1\n\n\n"},
+		{SubSupPandoc, "H~2~O and x^2^ \\+ y^n\\ \\+\\ 1^\n\n\n"},
+		{SubSupHTML, "H<sub>2</sub>O and x<sup>2</sup> \\+ y<sup>n + 1</sup>\n\n\n"},
+	} {
+		var buf bytes.Buffer
+		err := Convert(&buf, strings.NewReader(from), &Option{SubSupMode: tt.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("\nwant:\n%q}}}\ngot:\n%q}}}\n", tt.want, buf.String())
+		}
+	}
+}